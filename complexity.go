@@ -0,0 +1,101 @@
+package main
+
+import (
+	"compress/flate"
+	"log"
+	"sync"
+	"time"
+)
+
+// Complexity is a measurement of the structure of the soup beyond the
+// frequency of its values, which does not change when the cells are shuffled.
+type Complexity struct {
+	CompressionRatio   float64 // Compressed size over raw size, with DEFLATE
+	ConditionalEntropy float64 // Entropy of a cell given the cell before it, in bits
+	HighOrderEntropy   float64 // Shannon entropy minus the compressed bits per cell
+}
+
+// complexityMeter measures the soup in the background at an interval, so a
+// statistics report carries the latest measurement without waiting for it.
+type complexityMeter struct {
+	mu      sync.Mutex
+	latest  Complexity
+	last    time.Time // When the latest measurement started
+	running bool
+}
+
+// measure returns the latest measurement and starts a new one if the interval
+// has passed and none is running. An interval of 0 disables the measurements.
+func (m *complexityMeter) measure(s *AppState, interval time.Duration) Complexity {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if interval > 0 && !m.running && time.Since(m.last) >= interval {
+		m.running = true
+		m.last = time.Now()
+		go func() {
+			c := s.soupComplexity()
+			m.mu.Lock()
+			m.latest = c
+			m.running = false
+			m.mu.Unlock()
+		}()
+	}
+	return m.latest
+}
+
+// soupComplexity measures a copy of the soup taken while the IPs run, like
+// soupEntropies.
+func (s *AppState) soupComplexity() Complexity {
+	data := make([]byte, len(s.soup))
+	for i, v := range s.soup {
+		data[i] = byte(v)
+	}
+
+	var counts [256]int
+	var pairs [256 * 256]int
+	for i, v := range data {
+		counts[v]++
+		if i > 0 {
+			pairs[int(data[i-1])<<8|int(v)]++
+		}
+	}
+	shannon := entropy(counts[:], len(data))
+	// H(X_i | X_i-1) = H(X_i-1, X_i) - H(X_i-1)
+	conditional := entropy(pairs[:], len(data)-1) - shannon
+
+	compressed, err := compressedSize(data)
+	if err != nil {
+		log.Printf("Error compressing the soup: %v", err)
+		return Complexity{ConditionalEntropy: conditional}
+	}
+	ratio := float64(compressed) / float64(len(data))
+	return Complexity{
+		CompressionRatio:   ratio,
+		ConditionalEntropy: conditional,
+		HighOrderEntropy:   shannon - 8*ratio,
+	}
+}
+
+// compressedSize returns the size of data compressed with DEFLATE.
+func compressedSize(data []byte) (int64, error) {
+	var counter byteCounter
+	w, err := flate.NewWriter(&counter, flate.BestCompression)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	return int64(counter), nil
+}
+
+// byteCounter is a writer that only counts the bytes written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestSoupComplexity(t *testing.T) {
+	const n = 1 << 14
+	random := rand.New(rand.NewSource(1))
+	// There is one pair fewer than cells, which can take a conditional
+	// entropy of 0 slightly below it.
+	tests := []struct {
+		name                     string
+		cell                     func(i int) int8
+		ratio, conditional, high [2]float64 // Ranges the measurements must fall in
+	}{
+		{
+			name:        "uniform",
+			cell:        func(i int) int8 { return 0 },
+			ratio:       [2]float64{0, 0.01},
+			conditional: [2]float64{0, 0},
+			high:        [2]float64{-0.08, 0},
+		},
+		{
+			// Every value equally often, so the Shannon entropy is the
+			// maximum of 8 bits, but each cell determines the next.
+			name:        "counting",
+			cell:        func(i int) int8 { return int8(i) },
+			ratio:       [2]float64{0, 0.05},
+			conditional: [2]float64{-0.001, 0.001},
+			high:        [2]float64{7.6, 8},
+		},
+		{
+			name:        "alternating",
+			cell:        func(i int) int8 { return int8(i % 2) },
+			ratio:       [2]float64{0, 0.01},
+			conditional: [2]float64{-0.001, 0.001},
+			high:        [2]float64{0.92, 1},
+		},
+		{
+			// Incompressible, and the cell before tells nothing. The
+			// conditional entropy is underestimated with 64 samples per
+			// value, so it only has to be well above the structured cases.
+			name:        "random",
+			cell:        func(i int) int8 { return int8(random.Intn(256)) },
+			ratio:       [2]float64{1, 1.01},
+			conditional: [2]float64{5, 8},
+			high:        [2]float64{-0.1, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &AppState{soup: make([]int8, n)}
+			for i := range s.soup {
+				s.soup[i] = tt.cell(i)
+			}
+			c := s.soupComplexity()
+			check := func(name string, got float64, want [2]float64) {
+				if got < want[0]-1e-9 || got > want[1]+1e-9 || math.IsNaN(got) {
+					t.Errorf("%s is %.4f, want it in [%g, %g]", name, got, want[0], want[1])
+				}
+			}
+			check("compression ratio", c.CompressionRatio, tt.ratio)
+			check("conditional entropy", c.ConditionalEntropy, tt.conditional)
+			check("high-order entropy", c.HighOrderEntropy, tt.high)
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+)
+
+// Config holds the run parameters that can be changed without recompiling.
+// They are read from a JSON file given with -config and from the matching
+// command-line flags, which take precedence, and every snapshot records them.
+type Config struct {
+	SoupGridDim           int     `json:"soupGridDim"`           // Creates a (SoupGridDim x SoupGridDim) grid of blocks
+	VisDim                int     `json:"visDim"`                // Dimension of a square block, the area shown and measured at once
+	InitialIPs            int     `json:"initialIPs"`            // IPs in a new soup, 0 for 8192 per block
+	Use32BitAddressing    bool    `json:"use32BitAddressing"`    // Pointers span 16 bits per axis instead of 4 or 8
+	UseRelativeAddressing bool    `json:"useRelativeAddressing"` // Pointers are offsets from the instruction rather than coordinates
+	CosmicRayRate         float64 `json:"cosmicRayRate"`         // Probability of a bit flip per simulator iteration (per step in deterministic mode)
+	TargetFPS             int     `json:"targetFPS"`             // Frames per second sent to the frontend
+	SnapshotInterval      int     `json:"snapshotInterval"`      // Seconds between periodic snapshots, 0 disables them
+	SnapshotKeep          int     `json:"snapshotKeep"`          // Most recent periodic snapshots kept, 0 keeps them all and lets them fill the disk
+	SnapshotKeepHourly    int     `json:"snapshotKeepHourly"`    // Hours for which one older snapshot per hour is kept
+	SnapshotKeepDaily     int     `json:"snapshotKeepDaily"`     // Days for which one older snapshot per day is kept
+	SnapshotEntropyDrop   float64 `json:"snapshotEntropyDrop"`   // Snapshot when entropy falls this many bits below its peak, 0 disables
+	SnapshotEntropyWindow int     `json:"snapshotEntropyWindow"` // Statistics reports (seconds) the entropy peak is taken over
+	TimelineInterval      int     `json:"timelineInterval"`      // Seconds between points of the in-memory timeline, 0 disables it
+	TimelineWindow        int     `json:"timelineWindow"`        // Seconds of run time the timeline reaches back
+	TimelineCheckpoint    int     `json:"timelineCheckpoint"`    // Timeline points per full checkpoint, the others only record changes
+	ComplexityInterval    int     `json:"complexityInterval"`    // Seconds between complexity measurements of the soup, 0 disables them
+	MixInterval           int     `json:"mixInterval"`           // Seconds between reports of the instruction mix, 0 disables them
+	MotifInterval         int     `json:"motifInterval"`         // Seconds between searches for motifs, 0 disables them
+	MotifLength           int     `json:"motifLength"`           // Cells per motif
+	MotifMinCount         int     `json:"motifMinCount"`         // Fewest copies of a motif
+	MotifTop              int     `json:"motifTop"`              // Most motifs reported
+}
+
+// DefaultConfig returns the parameters EvoSoup has always run with.
+func DefaultConfig() Config {
+	return Config{
+		SoupGridDim:           1,
+		VisDim:                1024,
+		UseRelativeAddressing: true,
+		CosmicRayRate:         0.001,
+		TargetFPS:             30,
+		SnapshotInterval:      600,
+		SnapshotKeep:          24,
+		SnapshotKeepHourly:    24,
+		SnapshotKeepDaily:     30,
+		SnapshotEntropyWindow: 60,
+		TimelineInterval:      0,
+		TimelineWindow:        600,
+		TimelineCheckpoint:    6,
+		ComplexityInterval:    10,
+		MixInterval:           10,
+		MotifInterval:         30,
+		MotifLength:           8,
+		MotifMinCount:         4,
+		MotifTop:              10,
+	}
+}
+
+// withProcessSettings returns c with the settings that belong to the running
+// process rather than to the simulation, the frame rate, the snapshot schedule,
+// the timeline and the measurements, taken from p.
+func (c Config) withProcessSettings(p Config) Config {
+	c.TargetFPS = p.TargetFPS
+	c.SnapshotInterval = p.SnapshotInterval
+	c.SnapshotKeep = p.SnapshotKeep
+	c.SnapshotKeepHourly = p.SnapshotKeepHourly
+	c.SnapshotKeepDaily = p.SnapshotKeepDaily
+	c.SnapshotEntropyDrop = p.SnapshotEntropyDrop
+	c.SnapshotEntropyWindow = p.SnapshotEntropyWindow
+	c.TimelineInterval = p.TimelineInterval
+	c.TimelineWindow = p.TimelineWindow
+	c.TimelineCheckpoint = p.TimelineCheckpoint
+	c.ComplexityInterval = p.ComplexityInterval
+	c.MixInterval = p.MixInterval
+	c.MotifInterval = p.MotifInterval
+	c.MotifLength = p.MotifLength
+	c.MotifMinCount = p.MotifMinCount
+	c.MotifTop = p.MotifTop
+	return c
+}
+
+// SoupDim returns the number of cells per side of the soup.
+func (c Config) SoupDim() int32 {
+	return int32(c.SoupGridDim * c.VisDim)
+}
+
+// SoupSize returns the number of cells in the soup.
+func (c Config) SoupSize() int {
+	return c.SoupGridDim * c.VisDim * c.SoupGridDim * c.VisDim
+}
+
+// StatsAndVisSize returns the number of cells in one block, the portion of
+// the soup used for statistics and visualization.
+func (c Config) StatsAndVisSize() int {
+	return c.VisDim * c.VisDim
+}
+
+// NumIPs returns the number of IPs a new soup starts with.
+func (c Config) NumIPs() int {
+	if c.InitialIPs > 0 {
+		return c.InitialIPs
+	}
+	return 8192 * c.SoupGridDim * c.SoupGridDim
+}
+
+// Validate checks that the parameters describe a soup the VM can run.
+func (c Config) Validate() error {
+	if c.SoupGridDim < 1 {
+		return fmt.Errorf("soupGridDim must be at least 1, got %d", c.SoupGridDim)
+	}
+	if c.VisDim < 2 {
+		return fmt.Errorf("visDim must be at least 2, got %d", c.VisDim)
+	}
+	// Soup addresses are int32, and 32-bit pointers hold 16 bits per axis.
+	dim := int64(c.SoupGridDim) * int64(c.VisDim)
+	if dim > 1<<16 || dim*dim > math.MaxInt32 {
+		return fmt.Errorf("soup of %dx%d cells is too large to address", dim, dim)
+	}
+	// Absolute pointers must be able to reach every cell.
+	if !c.UseRelativeAddressing {
+		reach := int64(1 << 8)
+		if c.Use32BitAddressing {
+			reach = 1 << 16
+		}
+		if dim > reach {
+			return fmt.Errorf("soup of %dx%d cells does not fit absolute addressing, which reaches %dx%d cells", dim, dim, reach, reach)
+		}
+	}
+	if c.InitialIPs < 0 {
+		return fmt.Errorf("initialIPs must not be negative, got %d", c.InitialIPs)
+	}
+	if c.CosmicRayRate < 0 || c.CosmicRayRate > 1 {
+		return fmt.Errorf("cosmicRayRate must be between 0 and 1, got %g", c.CosmicRayRate)
+	}
+	if c.TargetFPS < 1 || c.TargetFPS > 240 {
+		return fmt.Errorf("targetFPS must be between 1 and 240, got %d", c.TargetFPS)
+	}
+	if c.SnapshotInterval < 0 {
+		return fmt.Errorf("snapshotInterval must not be negative, got %d", c.SnapshotInterval)
+	}
+	if c.SnapshotKeep < 0 || c.SnapshotKeepHourly < 0 || c.SnapshotKeepDaily < 0 {
+		return fmt.Errorf("snapshot retention counts must not be negative")
+	}
+	if c.SnapshotEntropyDrop < 0 {
+		return fmt.Errorf("snapshotEntropyDrop must not be negative, got %g", c.SnapshotEntropyDrop)
+	}
+	if c.SnapshotEntropyDrop > 0 && c.SnapshotEntropyWindow < 1 {
+		return fmt.Errorf("snapshotEntropyWindow must be at least 1, got %d", c.SnapshotEntropyWindow)
+	}
+	if c.TimelineInterval < 0 {
+		return fmt.Errorf("timelineInterval must not be negative, got %d", c.TimelineInterval)
+	}
+	if c.TimelineInterval > 0 && c.TimelineWindow < c.TimelineInterval {
+		return fmt.Errorf("timelineWindow must be at least timelineInterval, got %d", c.TimelineWindow)
+	}
+	if c.TimelineInterval > 0 && c.TimelineCheckpoint < 1 {
+		return fmt.Errorf("timelineCheckpoint must be at least 1, got %d", c.TimelineCheckpoint)
+	}
+	if c.ComplexityInterval < 0 {
+		return fmt.Errorf("complexityInterval must not be negative, got %d", c.ComplexityInterval)
+	}
+	if c.MixInterval < 0 {
+		return fmt.Errorf("mixInterval must not be negative, got %d", c.MixInterval)
+	}
+	if c.MotifInterval < 0 {
+		return fmt.Errorf("motifInterval must not be negative, got %d", c.MotifInterval)
+	}
+	if c.MotifInterval > 0 {
+		if err := c.motifOptions().Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadConfig reads a JSON config file over the defaults. Parameters missing
+// from the file keep their default values.
+func LoadConfig(filename string) (Config, error) {
+	cfg := DefaultConfig()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse config file %s: %w", filename, err)
+	}
+	return cfg, nil
+}
+
+// configFlags are the command-line flags matching the Config fields.
+type configFlags struct {
+	file             *string
+	soupGridDim      *int
+	visDim           *int
+	initialIPs       *int
+	use32Bit         *bool
+	relative         *bool
+	cosmicRayRate    *float64
+	targetFPS        *int
+	snapshotInterval *int
+	keep             *int
+	keepHourly       *int
+	keepDaily        *int
+	entropyDrop      *float64
+	entropyWindow    *int
+	timelineInterval *int
+	timelineWindow   *int
+	checkpoint       *int
+	complexity       *int
+	mix              *int
+	motifInterval    *int
+	motifLength      *int
+	motifMinCount    *int
+	motifTop         *int
+}
+
+// registerConfigFlags defines the config flags on fs.
+func registerConfigFlags(fs *flag.FlagSet) *configFlags {
+	d := DefaultConfig()
+	return &configFlags{
+		file:             fs.String("config", "", "JSON file with run parameters. Flags given on the command line override it."),
+		soupGridDim:      fs.Int("grid", d.SoupGridDim, "The soup is a grid x grid array of blocks."),
+		visDim:           fs.Int("vis-dim", d.VisDim, "Cells per side of a block, the area visualized and measured at once."),
+		initialIPs:       fs.Int("ips", d.InitialIPs, "IPs in a new soup. 0 starts 8192 per block."),
+		use32Bit:         fs.Bool("addressing32", d.Use32BitAddressing, "Start with 32-bit addressing."),
+		relative:         fs.Bool("relative-addressing", d.UseRelativeAddressing, "Start with relative addressing."),
+		cosmicRayRate:    fs.Float64("cosmic-rate", d.CosmicRayRate, "Initial cosmic ray rate."),
+		targetFPS:        fs.Int("fps", d.TargetFPS, "Frames per second sent to the frontend."),
+		snapshotInterval: fs.Int("snapshot-interval", d.SnapshotInterval, "Seconds between periodic snapshots. 0 disables them."),
+		keep:             fs.Int("snapshot-keep", d.SnapshotKeep, "Most recent periodic snapshots of this run to keep, thinning the older ones. 0 keeps them all, so a long run grows without bound."),
+		keepHourly:       fs.Int("snapshot-keep-hourly", d.SnapshotKeepHourly, "Hours for which one older periodic snapshot per hour is kept."),
+		keepDaily:        fs.Int("snapshot-keep-daily", d.SnapshotKeepDaily, "Days for which one older periodic snapshot per day is kept."),
+		entropyDrop:      fs.Float64("snapshot-entropy-drop", d.SnapshotEntropyDrop, "Take a snapshot when the entropy falls this many bits below its recent peak. 0 disables."),
+		entropyWindow:    fs.Int("snapshot-entropy-window", d.SnapshotEntropyWindow, "Seconds of statistics the entropy peak is taken over."),
+		timelineInterval: fs.Int("timeline-interval", d.TimelineInterval, "Seconds between points of the in-memory timeline for rewinding. Each point stops every IP to copy the state, and the goroutine policy then restarts a goroutine per IP, so short intervals slow large runs down. 0 disables it."),
+		timelineWindow:   fs.Int("timeline-window", d.TimelineWindow, "Seconds of run time the timeline reaches back."),
+		checkpoint:       fs.Int("timeline-checkpoint", d.TimelineCheckpoint, "Timeline points per full checkpoint. The others only record the cells that changed."),
+		complexity:       fs.Int("complexity-interval", d.ComplexityInterval, "Seconds between measurements of the compression ratio and higher-order entropies of the soup. 0 disables them."),
+		mix:              fs.Int("mix-interval", d.MixInterval, "Seconds between reports of the instruction mix of the soup and of the IPs. 0 disables them."),
+		motifInterval:    fs.Int("motif-interval", d.MotifInterval, "Seconds between searches for motifs, row segments repeated in the soup. 0 disables them."),
+		motifLength:      fs.Int("motif-length", d.MotifLength, "Cells per motif."),
+		motifMinCount:    fs.Int("motif-min-count", d.MotifMinCount, "Fewest copies of a motif."),
+		motifTop:         fs.Int("motif-top", d.MotifTop, "Most motifs reported."),
+	}
+}
+
+// resolve builds the config from the defaults, the config file and the flags
+// set on the command line, in increasing order of precedence.
+func (f *configFlags) resolve(fs *flag.FlagSet) (Config, error) {
+	cfg := DefaultConfig()
+	if *f.file != "" {
+		var err error
+		if cfg, err = LoadConfig(*f.file); err != nil {
+			return cfg, err
+		}
+	}
+	fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "grid":
+			cfg.SoupGridDim = *f.soupGridDim
+		case "vis-dim":
+			cfg.VisDim = *f.visDim
+		case "ips":
+			cfg.InitialIPs = *f.initialIPs
+		case "addressing32":
+			cfg.Use32BitAddressing = *f.use32Bit
+		case "relative-addressing":
+			cfg.UseRelativeAddressing = *f.relative
+		case "cosmic-rate":
+			cfg.CosmicRayRate = *f.cosmicRayRate
+		case "fps":
+			cfg.TargetFPS = *f.targetFPS
+		case "snapshot-interval":
+			cfg.SnapshotInterval = *f.snapshotInterval
+		case "snapshot-keep":
+			cfg.SnapshotKeep = *f.keep
+		case "snapshot-keep-hourly":
+			cfg.SnapshotKeepHourly = *f.keepHourly
+		case "snapshot-keep-daily":
+			cfg.SnapshotKeepDaily = *f.keepDaily
+		case "snapshot-entropy-drop":
+			cfg.SnapshotEntropyDrop = *f.entropyDrop
+		case "snapshot-entropy-window":
+			cfg.SnapshotEntropyWindow = *f.entropyWindow
+		case "timeline-interval":
+			cfg.TimelineInterval = *f.timelineInterval
+		case "timeline-window":
+			cfg.TimelineWindow = *f.timelineWindow
+		case "timeline-checkpoint":
+			cfg.TimelineCheckpoint = *f.checkpoint
+		case "complexity-interval":
+			cfg.ComplexityInterval = *f.complexity
+		case "mix-interval":
+			cfg.MixInterval = *f.mix
+		case "motif-interval":
+			cfg.MotifInterval = *f.motifInterval
+		case "motif-length":
+			cfg.MotifLength = *f.motifLength
+		case "motif-min-count":
+			cfg.MotifMinCount = *f.motifMinCount
+		case "motif-top":
+			cfg.MotifTop = *f.motifTop
+		}
+	})
+	return cfg, cfg.Validate()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   string // Substring of the error, empty for a valid config
+	}{
+		{"large soup", func(c *Config) { c.SoupGridDim, c.VisDim = 8, 4096 }, ""},
+		{"no blocks", func(c *Config) { c.SoupGridDim = 0 }, "soupGridDim"},
+		{"tiny blocks", func(c *Config) { c.VisDim = 1 }, "visDim"},
+		{"soup too large", func(c *Config) { c.SoupGridDim, c.VisDim = 64, 2048 }, "too large to address"},
+		{"absolute 8-bit addressing", func(c *Config) { c.UseRelativeAddressing = false }, "does not fit absolute addressing"},
+		{"absolute 32-bit addressing", func(c *Config) { c.UseRelativeAddressing, c.Use32BitAddressing = false, true }, ""},
+		{"small absolute soup", func(c *Config) { c.UseRelativeAddressing, c.VisDim = false, 256 }, ""},
+		{"negative IPs", func(c *Config) { c.InitialIPs = -1 }, "initialIPs"},
+		{"cosmic rate above 1", func(c *Config) { c.CosmicRayRate = 1.5 }, "cosmicRayRate"},
+		{"no frames", func(c *Config) { c.TargetFPS = 0 }, "targetFPS"},
+		{"negative retention", func(c *Config) { c.SnapshotKeepDaily = -1 }, "retention"},
+		{"entropy drop without window", func(c *Config) { c.SnapshotEntropyDrop, c.SnapshotEntropyWindow = 1, 0 }, "snapshotEntropyWindow"},
+		{"timeline window below interval", func(c *Config) { c.TimelineInterval, c.TimelineWindow = 60, 30 }, "timelineWindow"},
+		{"timeline without checkpoints", func(c *Config) { c.TimelineInterval, c.TimelineCheckpoint = 10, 0 }, "timelineCheckpoint"},
+		{"motifs too short", func(c *Config) { c.MotifLength = 1 }, "motifLength"},
+		{"disabled motifs", func(c *Config) { c.MotifInterval, c.MotifLength = 0, 1 }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tt.change(&c)
+			err := c.Validate()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("Validate: %v", err)
+			case tt.want != "" && err == nil:
+				t.Errorf("Validate accepted %+v", c)
+			case tt.want != "" && !strings.Contains(err.Error(), tt.want):
+				t.Errorf("Validate error %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigFlagsOverrideFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(filename, []byte(`{"visDim": 64, "cosmicRayRate": 0.5, "initialIPs": 100}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := registerConfigFlags(fs)
+	if err := fs.Parse([]string{"-config", filename, "-vis-dim", "128", "-ips", "0"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := flags.resolve(fs)
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	want := DefaultConfig()
+	want.VisDim = 128
+	want.CosmicRayRate = 0.5
+	if cfg != want {
+		t.Errorf("resolved %+v, want %+v", cfg, want)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"evolution/vm"
+)
+
+// debugPoints is an immutable set of breakpoints and watchpoints. The debugger
+// swaps in a new set on every change so IPs can read it without locking.
+type debugPoints struct {
+	breakpoints map[int32]bool // Pause when an IP is about to execute one of these cells
+	watchpoints map[int32]bool // Pause when one of these cells changes value
+}
+
+// Debugger pauses the simulation on breakpoints and watchpoints. It observes
+// every IP while any point is set and is detached otherwise, so it costs
+// nothing when unused. The IP that hits a point halts at once and the others
+// within a step, before the main loop pauses the simulation.
+type Debugger struct {
+	mu       sync.Mutex // Serializes changes to points
+	points   atomic.Value
+	focusID  int32 // IP whose state is reported while paused (atomic)
+	soupDimX int32 // Row length of the soup, to turn IP positions into cells
+	halting  int32 // Set by a hit until the pause it asks for (atomic)
+	hits     chan string
+}
+
+// NewDebugger creates a debugger with no points set.
+func NewDebugger() *Debugger {
+	d := &Debugger{hits: make(chan string, 1)}
+	d.points.Store(&debugPoints{breakpoints: map[int32]bool{}, watchpoints: map[int32]bool{}})
+	return d
+}
+
+func (d *Debugger) load() *debugPoints {
+	return d.points.Load().(*debugPoints)
+}
+
+// Active reports whether any breakpoint or watchpoint is set.
+func (d *Debugger) Active() bool {
+	p := d.load()
+	return len(p.breakpoints) > 0 || len(p.watchpoints) > 0
+}
+
+// update applies fn to a copy of the current points and publishes the result.
+// It reports whether the change set the first point or cleared the last one.
+func (d *Debugger) update(fn func(p *debugPoints)) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	old := d.load()
+	p := &debugPoints{
+		breakpoints: make(map[int32]bool, len(old.breakpoints)),
+		watchpoints: make(map[int32]bool, len(old.watchpoints)),
+	}
+	for addr := range old.breakpoints {
+		p.breakpoints[addr] = true
+	}
+	for addr := range old.watchpoints {
+		p.watchpoints[addr] = true
+	}
+	fn(p)
+	d.points.Store(p)
+	wasActive := len(old.breakpoints) > 0 || len(old.watchpoints) > 0
+	return wasActive != (len(p.breakpoints) > 0 || len(p.watchpoints) > 0)
+}
+
+// ObserveStep checks a finished step against the breakpoints and watchpoints
+// and asks for the IP to halt on a hit.
+func (d *Debugger) ObserveStep(ev vm.StepEvent) bool {
+	p := d.load()
+	if len(p.watchpoints) > 0 && p.watchpoints[ev.DestAddr] && ev.OldValue != ev.Result {
+		d.hit(ev.ID, fmt.Sprintf("watchpoint: IP %d changed cell %d from %d to %d", ev.ID, ev.DestAddr, ev.OldValue, ev.Result))
+		return true
+	}
+	if len(p.breakpoints) > 0 && p.breakpoints[ev.NextY*d.soupDimX+ev.NextX] {
+		d.hit(ev.ID, fmt.Sprintf("breakpoint: IP %d reached (%d, %d)", ev.ID, ev.NextX, ev.NextY))
+		return true
+	}
+	return false
+}
+
+// hit focuses the IP that triggered a point, halts the schedulers and asks
+// for a pause. Only the first hit before the pause is kept.
+func (d *Debugger) hit(id int, reason string) {
+	atomic.StoreInt32(&d.halting, 1)
+	select {
+	case d.hits <- reason:
+		atomic.StoreInt32(&d.focusID, int32(id))
+	default:
+	}
+}
+
+// Halting reports whether a hit is waiting for its pause. Every scheduler
+// stops stepping while it is set, so the pause shows the soup as the hit
+// left it.
+func (d *Debugger) Halting() bool {
+	return atomic.LoadInt32(&d.halting) == 1
+}
+
+// drain discards a pending hit and lets the IPs run again.
+func (d *Debugger) drain() {
+	select {
+	case <-d.hits:
+	default:
+	}
+	atomic.StoreInt32(&d.halting, 0)
+}
+
+// Hits delivers the reason for each requested pause.
+func (d *Debugger) Hits() <-chan string {
+	return d.hits
+}
+
+// DebugStateMessage reports the focused IP and its next instruction.
+type DebugStateMessage struct {
+	Type        string  `json:"type"`
+	Reason      string  `json:"reason,omitempty"`
+	Paused      bool    `json:"paused"`
+	ID          int     `json:"id"`
+	Found       bool    `json:"found"`
+	X           int32   `json:"x"`
+	Y           int32   `json:"y"`
+	Steps       int64   `json:"steps"`
+	Instruction int8    `json:"instruction"`
+	Disassembly string  `json:"disassembly"`
+	Src1Addr    int32   `json:"src1Addr"`
+	Src1Val     int8    `json:"src1Val"`
+	Src2Addr    int32   `json:"src2Addr"`
+	Src2Val     int8    `json:"src2Val"`
+	DestAddr    int32   `json:"destAddr"`
+	DestVal     int8    `json:"destVal"`
+	Result      int8    `json:"result"`
+	JumpTaken   bool    `json:"jumpTaken"`
+	Breakpoints []int32 `json:"breakpoints"`
+	Watchpoints []int32 `json:"watchpoints"`
+}
+
+func sortedAddrs(set map[int32]bool) []int32 {
+	addrs := make([]int32, 0, len(set))
+	for addr := range set {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	return addrs
+}
+
+// lookupIP finds an IP of the population by ID.
+func (s *AppState) lookupIP(id int) (*vm.IP, bool) {
+	val, ok := s.population.Load(id)
+	if !ok {
+		return nil, false
+	}
+	return val.(*vm.IP), true
+}
+
+// refreshObservers attaches the debugger to every IP while it has points set,
+// and detaches it otherwise. It must only run while the IPs are stopped.
+func (s *AppState) refreshObservers() {
+	var observer vm.Observer
+	if s.debugger.Active() {
+		observer = s.debugger
+	}
+	s.population.Range(func(key, value interface{}) bool {
+		value.(*vm.IP).Observer = observer
+		return true
+	})
+}
+
+// SetDebugFocus selects the IP whose state is reported while paused.
+func (s *AppState) SetDebugFocus(id int) {
+	atomic.StoreInt32(&s.debugger.focusID, int32(id))
+}
+
+// StepIP executes a single step of one IP while the simulation is paused.
+func (s *AppState) StepIP(id int) {
+	s.controlMu.Lock()
+	defer s.controlMu.Unlock()
+	if atomic.LoadInt32(&s.paused) == 0 {
+		log.Println("step_ip command received, but simulation is not paused.")
+		return
+	}
+	ip, ok := s.lookupIP(id)
+	if !ok {
+		log.Printf("IP with ID %d not found to step.", id)
+		return
+	}
+	s.SetDebugFocus(id)
+	counts := s.startCounting()
+	defer s.stopCounting(counts)
+	ip.Counts = counts
+	ip.Step()
+	if s.dynamic() {
+		s.afterStep(ip)
+	}
+	// Points hit while single-stepping are reported by the step itself.
+	s.debugger.drain()
+	select {
+	case s.visRequestChan <- struct{}{}:
+	default:
+	}
+}
+
+// SetBreakpoint sets or clears a breakpoint on a soup cell.
+func (s *AppState) SetBreakpoint(addr int32, enabled bool) {
+	s.setDebugPoint(addr, enabled, func(p *debugPoints) map[int32]bool { return p.breakpoints })
+}
+
+// SetWatchpoint sets or clears a watchpoint on a soup cell.
+func (s *AppState) SetWatchpoint(addr int32, enabled bool) {
+	s.setDebugPoint(addr, enabled, func(p *debugPoints) map[int32]bool { return p.watchpoints })
+}
+
+// ClearDebugPoints removes every breakpoint and watchpoint.
+func (s *AppState) ClearDebugPoints() {
+	changed := s.debugger.update(func(p *debugPoints) {
+		p.breakpoints = map[int32]bool{}
+		p.watchpoints = map[int32]bool{}
+	})
+	if changed {
+		s.quiesce(s.refreshObservers)
+	}
+}
+
+func (s *AppState) setDebugPoint(addr int32, enabled bool, set func(p *debugPoints) map[int32]bool) {
+	if addr < 0 || int(addr) >= len(s.soup) {
+		log.Printf("Debug point %d is outside the soup.", addr)
+		return
+	}
+	changed := s.debugger.update(func(p *debugPoints) {
+		if enabled {
+			set(p)[addr] = true
+		} else {
+			delete(set(p), addr)
+		}
+	})
+	// Attached IPs read the new points on their next step, so only setting
+	// the first point or clearing the last one needs the IPs stopped.
+	if changed {
+		s.quiesce(s.refreshObservers)
+	}
+}
+
+// DebugState encodes the state of the focused IP, with the reason for the
+// last pause if there is one. The IP is only reported while paused: a running
+// IP changes under the reader, and its preview would go through the memory
+// model the IP's own goroutine is using.
+func (s *AppState) DebugState(reason string) ([]byte, error) {
+	// Hold off Resume while the IP is read.
+	s.controlMu.Lock()
+	defer s.controlMu.Unlock()
+	p := s.debugger.load()
+	id := int(atomic.LoadInt32(&s.debugger.focusID))
+	msg := DebugStateMessage{
+		Type:        "debug_state",
+		Reason:      reason,
+		Paused:      atomic.LoadInt32(&s.paused) == 1,
+		ID:          id,
+		Breakpoints: sortedAddrs(p.breakpoints),
+		Watchpoints: sortedAddrs(p.watchpoints),
+	}
+	if !msg.Paused {
+		return json.Marshal(msg)
+	}
+	if ip, ok := s.lookupIP(id); ok {
+		ev := ip.Preview()
+		msg.Found = true
+		msg.X, msg.Y = ip.X, ip.Y
+		msg.Steps = ip.Steps
+		msg.Instruction = ev.Instruction
+		msg.Disassembly = vm.DisassembleInstruction(s.isa, ev.Instruction)
+		msg.Src1Addr, msg.Src1Val = ev.Src1Addr, ev.Src1Val
+		msg.Src2Addr, msg.Src2Val = ev.Src2Addr, ev.Src2Val
+		msg.DestAddr, msg.DestVal = ev.DestAddr, ev.OldValue
+		msg.Result = ev.Result
+		msg.JumpTaken = ev.JumpTaken
+	}
+	return json.Marshal(msg)
+}
+
+// broadcastDebugState sends the debugger's view of the focused IP to all
+// clients.
+func broadcastDebugState(hub *Hub, appState *AppState, reason string) {
+	jsonData, err := appState.DebugState(reason)
+	if err != nil {
+		log.Printf("error marshalling debug state: %v", err)
+		return
+	}
+	hub.Broadcast <- jsonData
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LineageNode is a motif in the lineage tree, see MotifTracker.
+type LineageNode struct {
+	ID        int     `json:"id"`
+	Cells     []int8  `json:"cells"`
+	Parent    int     `json:"parent"`   // ID of the closest earlier motif, -1 for the first ones seen
+	Distance  int     `json:"distance"` // Edit distance from the parent
+	FirstSeen float64 `json:"firstSeen"`
+	LastSeen  float64 `json:"lastSeen"`
+	PeakCount int     `json:"peakCount"`
+	PeakAt    float64 `json:"peakAt"`
+}
+
+// editDistance returns the Levenshtein distance between two motifs, the
+// fewest cells to insert, delete or change to turn one into the other.
+func editDistance(a, b []int8) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// Lineage export formats.
+const (
+	LineageJSON    = "json"
+	LineageDOT     = "dot"
+	LineageGraphML = "graphml"
+)
+
+// lineageFormat returns the export format of a lineage file from its
+// extension.
+func lineageFormat(filename string) (string, error) {
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".json":
+		return LineageJSON, nil
+	case ".dot", ".gv":
+		return LineageDOT, nil
+	case ".graphml":
+		return LineageGraphML, nil
+	default:
+		return "", fmt.Errorf("unknown lineage format %q, use .json, .dot or .graphml", ext)
+	}
+}
+
+// writeLineage writes the lineage to w in the given format.
+func writeLineage(w io.Writer, format string, nodes []LineageNode) error {
+	switch format {
+	case LineageJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Nodes []LineageNode `json:"nodes"`
+		}{nodes})
+	case LineageDOT:
+		return writeLineageDOT(w, nodes)
+	case LineageGraphML:
+		return writeLineageGraphML(w, nodes)
+	default:
+		return fmt.Errorf("unknown lineage format %q", format)
+	}
+}
+
+// writeLineageDOT writes the lineage as a Graphviz digraph, an edge from
+// each motif to the motifs descending from it.
+func writeLineageDOT(w io.Writer, nodes []LineageNode) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph lineage {")
+	fmt.Fprintln(bw, `  node [shape=box, fontname="monospace"];`)
+	for _, n := range nodes {
+		fmt.Fprintf(bw, "  m%d [label=\"#%d %s\\nfirst seen %s\\npeak %d at %s\"];\n",
+			n.ID, n.ID, cellsHex(n.Cells), runTime(n.FirstSeen), n.PeakCount, runTime(n.PeakAt))
+	}
+	for _, n := range nodes {
+		if n.Parent >= 0 {
+			fmt.Fprintf(bw, "  m%d -> m%d [label=\"%d\"];\n", n.Parent, n.ID, n.Distance)
+		}
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// writeLineageGraphML writes the lineage as a GraphML directed graph, with
+// the motif fields as node data and the edit distance as edge data.
+func writeLineageGraphML(w io.Writer, nodes []LineageNode) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, `<?xml version="1.0" encoding="UTF-8"?>`)
+	fmt.Fprintln(bw, `<graphml xmlns="http://graphml.graphdrawing.org/xmlns">`)
+	fmt.Fprintln(bw, `  <key id="cells" for="node" attr.name="cells" attr.type="string"/>`)
+	fmt.Fprintln(bw, `  <key id="firstSeen" for="node" attr.name="firstSeen" attr.type="double"/>`)
+	fmt.Fprintln(bw, `  <key id="lastSeen" for="node" attr.name="lastSeen" attr.type="double"/>`)
+	fmt.Fprintln(bw, `  <key id="peakCount" for="node" attr.name="peakCount" attr.type="int"/>`)
+	fmt.Fprintln(bw, `  <key id="peakAt" for="node" attr.name="peakAt" attr.type="double"/>`)
+	fmt.Fprintln(bw, `  <key id="distance" for="edge" attr.name="distance" attr.type="int"/>`)
+	fmt.Fprintln(bw, `  <graph id="lineage" edgedefault="directed">`)
+	for _, n := range nodes {
+		fmt.Fprintf(bw, "    <node id=\"m%d\">\n", n.ID)
+		fmt.Fprintf(bw, "      <data key=\"cells\">%s</data>\n", cellsHex(n.Cells))
+		fmt.Fprintf(bw, "      <data key=\"firstSeen\">%g</data>\n", n.FirstSeen)
+		fmt.Fprintf(bw, "      <data key=\"lastSeen\">%g</data>\n", n.LastSeen)
+		fmt.Fprintf(bw, "      <data key=\"peakCount\">%d</data>\n", n.PeakCount)
+		fmt.Fprintf(bw, "      <data key=\"peakAt\">%g</data>\n", n.PeakAt)
+		fmt.Fprintln(bw, "    </node>")
+	}
+	for _, n := range nodes {
+		if n.Parent >= 0 {
+			fmt.Fprintf(bw, "    <edge source=\"m%d\" target=\"m%d\">\n", n.Parent, n.ID)
+			fmt.Fprintf(bw, "      <data key=\"distance\">%d</data>\n", n.Distance)
+			fmt.Fprintln(bw, "    </edge>")
+		}
+	}
+	fmt.Fprintln(bw, "  </graph>")
+	fmt.Fprintln(bw, "</graphml>")
+	return bw.Flush()
+}
+
+// exportLineage writes the lineage to a file in the format of its extension.
+// The file is replaced at once, so it is never seen half written.
+func exportLineage(filename string, nodes []LineageNode) error {
+	format, err := lineageFormat(filename)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create lineage file: %w", err)
+	}
+	if err := writeLineage(file, format, nodes); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write lineage: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write lineage: %w", err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("failed to replace lineage file: %w", err)
+	}
+	return nil
+}
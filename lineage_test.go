@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b []int8
+		want int
+	}{
+		{nil, nil, 0},
+		{[]int8{1, 2, 3}, nil, 3},
+		{nil, []int8{1, 2}, 2},
+		{[]int8{1, 2, 3}, []int8{1, 2, 3}, 0},
+		{[]int8{1, 2, 3}, []int8{1, 9, 3}, 1},    // Change
+		{[]int8{1, 2, 3}, []int8{1, 3}, 1},       // Deletion
+		{[]int8{1, 2, 3}, []int8{0, 1, 2, 3}, 1}, // Insertion
+		{[]int8{1, 2, 3, 4}, []int8{2, 3, 4, 5}, 2},
+		{[]int8{1, 2, 3}, []int8{4, 5, 6}, 3},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%v, %v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := editDistance(tt.b, tt.a); got != tt.want {
+			t.Errorf("editDistance(%v, %v) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestMotifTracker(t *testing.T) {
+	a := []int8{1, 2, 3, 4}
+	b := []int8{5, 6, 7, 8}
+	c := []int8{5, 6, 7, 9} // One change from b
+	d := []int8{1, 2, 3, 5} // One change from a
+
+	tracker := NewMotifTracker()
+	first := []Motif{{Cells: a, Count: 3}, {Cells: b, Count: 2}}
+	tracker.Observe(first, time.Second)
+	second := []Motif{{Cells: a, Count: 5}, {Cells: c, Count: 2}}
+	tracker.Observe(second, 2*time.Second)
+	third := []Motif{{Cells: a, Count: 4}}
+	tracker.Observe(third, 3*time.Second)
+
+	// Motifs found together in their first analysis have no parent.
+	if first[0].ID != 0 || first[0].Parent != -1 || first[1].ID != 1 || first[1].Parent != -1 {
+		t.Errorf("first analysis tracked as %+v", first)
+	}
+	if m := second[0]; m.ID != 0 || m.FirstSeen != 1 || m.PeakCount != 5 || m.PeakAt != 2 {
+		t.Errorf("motif seen again tracked as %+v", m)
+	}
+	if m := second[1]; m.ID != 2 || m.Parent != 1 || m.FirstSeen != 2 {
+		t.Errorf("new motif tracked as %+v, want ID 2 descending from 1", m)
+	}
+	if m := third[0]; m.PeakCount != 5 || m.PeakAt != 2 {
+		t.Errorf("declining motif tracked as %+v, want its peak kept", m)
+	}
+
+	nodes, nextID := tracker.Save()
+	if len(nodes) != 3 || nextID != 3 {
+		t.Fatalf("saved %d nodes and next ID %d, want 3 and 3", len(nodes), nextID)
+	}
+	if n := nodes[0]; n.LastSeen != 3 {
+		t.Errorf("motif last seen at %g, want 3", n.LastSeen)
+	}
+	if n := nodes[2]; n.Distance != 1 {
+		t.Errorf("motif at distance %d from its parent, want 1", n.Distance)
+	}
+	if err := checkLineage(nodes, nextID); err != nil {
+		t.Fatalf("checkLineage: %v", err)
+	}
+
+	// A restored tracker continues the lineage.
+	restored := NewMotifTracker()
+	restored.Restore(nodes, nextID)
+	fourth := []Motif{{Cells: a, Count: 1}, {Cells: d, Count: 2}}
+	restored.Observe(fourth, 4*time.Second)
+	if fourth[0].ID != 0 || fourth[1].ID != 3 || fourth[1].Parent != 0 {
+		t.Errorf("restored tracker tracked %+v, want a known and a new motif descending from it", fourth)
+	}
+}
+
+func TestCheckLineage(t *testing.T) {
+	tests := []struct {
+		name   string
+		nodes  []LineageNode
+		nextID int
+		ok     bool
+	}{
+		{"empty", nil, 0, true},
+		{"tree", []LineageNode{{ID: 0, Parent: -1}, {ID: 2, Parent: 0}, {ID: 1, Parent: 2}}, 3, true},
+		{"duplicate ID", []LineageNode{{ID: 0, Parent: -1}, {ID: 0, Parent: -1}}, 1, false},
+		{"ID past next ID", []LineageNode{{ID: 1, Parent: -1}}, 1, false},
+		{"negative ID", []LineageNode{{ID: -1, Parent: -1}}, 1, false},
+		{"parent after child", []LineageNode{{ID: 1, Parent: 0}, {ID: 0, Parent: -1}}, 2, false},
+	}
+	for _, tt := range tests {
+		if err := checkLineage(tt.nodes, tt.nextID); (err == nil) != tt.ok {
+			t.Errorf("%s: checkLineage error %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
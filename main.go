@@ -1,69 +1,177 @@
 package main
 
 import (
+	"encoding/json"
 	"evolution/vm"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
-// --- Simulation Constants ---
-const (
-	SoupGridDim           = 1    // Creates a (SoupGridDim x SoupGridDim) grid of blocks.
-	VisDim                = 1024 // Dimension of the square visualization area (a single block).
-	SoupDimX              = SoupGridDim * VisDim
-	SoupDimY              = SoupGridDim * VisDim
-	SoupSize              = SoupDimX * SoupDimY
-	InitialNumIPs         = 8192 * (SoupGridDim * SoupGridDim)
-	TargetFPS             = 30 // Target a smooth FPS
-
-	// StatsAndVisSize represents the portion of the soup used for statistics and
-	// visualization, corresponding to a single 1024x1024 block.
-	StatsAndVisSize = VisDim * VisDim
-)
-
 // --- Structs ---
 
 // GenerationStats holds statistics for a single generation.
 type GenerationStats struct {
-	Generation     string  `json:"Generation"`
-	Population     int     `json:"Population"`
-	StepsPerSecond int64   `json:"StepsPerSecond"`
-	Entropy        float64 `json:"Entropy"`
+	Generation     string    `json:"Generation"`
+	Population     int       `json:"Population"`
+	StepsPerSecond int64     `json:"StepsPerSecond"`
+	Entropy        float64   `json:"Entropy"`                  // Of the whole soup, in bits per cell
+	BlockEntropies []float64 `json:"BlockEntropies,omitempty"` // Of each block, row by row, when the grid has more than one
+	Births         int64     `json:"Births"`                   // IPs born since the last report
+	Deaths         int64     `json:"Deaths"`                   // IPs that died since the last report
+
+	// Complexity of the whole soup at the latest measurement, see complexity.go
+	CompressionRatio   float64 `json:"CompressionRatio"`
+	ConditionalEntropy float64 `json:"ConditionalEntropy"`
+	HighOrderEntropy   float64 `json:"HighOrderEntropy"`
+
+	// Instruction mixes of the soup and of the executed instructions, only
+	// in the reports that carry them, see mix.go
+	StaticMix  *InstructionMix `json:"StaticMix,omitempty"`
+	DynamicMix *InstructionMix `json:"DynamicMix,omitempty"`
 }
 
 // SimulationState represents the entire state of the simulation to be saved.
+// Older snapshots lack some fields and are brought up to date on load, see
+// snapshot.go.
 type SimulationState struct {
-	Generation int
-	Soup       []int8
-	IPs        []vm.SavableIP
-	NextIPID   int32
-	RandSeed   int64 // To be able to resume with the same random sequence
+	Version     int       // Format version, see SnapshotVersion
+	SavedAt     time.Time // When the snapshot was written
+	Generation  int
+	Soup        []int8
+	IPs         []vm.SavableIP
+	NextIPID    int32  // Last IP ID issued, the next IP gets NextIPID+1
+	RandSeed    int64  // To be able to resume with the same random sequence
+	Config      Config // Run parameters, zero in snapshots that predate them
+	ISA         string // Name of the instruction set, empty for the classic ISA
+	MemoryModel string // Consistency model of soup accesses, empty for racy
+
+	// Scheduling and population dynamics.
+	SchedulePolicy string
+	Shards         int
+	IPLifetime     int64
+	Respawn        bool
+	SpawnOp        string
+	MaxIPs         int32
+	Births         int64
+	Deaths         int64
+	RetiredSteps   int64 // Steps executed by IPs that died
+
+	// Statistics, so a loaded run continues its clock and history.
+	TimeElapsed int64             // Microseconds of run time before the snapshot
+	History     []GenerationStats // Reports of RunStatistics, oldest first
+
+	// Deterministic mode state, needed to continue a replayable run.
+	Deterministic      bool
+	Rounds             int64
+	SchedulerRandState uint64
+
+	// Motif lineage, see MotifTracker, so a loaded run continues its tree.
+	Lineage     []LineageNode
+	NextMotifID int
 }
 
 func main() {
-	fmt.Println("--- EvoSoup: A Go-based Artificial Life Simulation ---")
+	if len(os.Args) > 1 && os.Args[1] == "sweep" {
+		sweepMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "motifs" {
+		motifsMain(os.Args[2:])
+		return
+	}
 
 	// --- Command-line flags ---
 	snapshotFilename := flag.String("snapshot", "snapshot.gob", "Filename for the final snapshot.")
 	loadFilename := flag.String("load", "", "Load a snapshot file to continue an experiment.")
+	metricsFilename := flag.String("metrics", "", "Append every statistics report to this file, as JSON lines if it ends in .jsonl, CSV otherwise.")
+	entropyFilename := flag.String("entropy", "", "Append every statistics report, including Generation and Entropy, to this CSV file.")
+	metricsFlush := flag.Int("metrics-flush", 5, "Seconds between flushes of the metrics files. 0 flushes every report.")
 	experimentDuration := flag.Int("duration", -1, "Time in minutes to run an experiment. Negative values run forever")
+	seed := flag.Int64("seed", 0, "Random seed for a new simulation. 0 picks one from the clock.")
+	deterministic := flag.Bool("deterministic", false, "Step IPs in a fixed order with per-IP random streams so a seed reproduces the same soup.")
+	rounds := flag.Int64("rounds", 0, "In deterministic mode, stop after this many rounds (one step of every IP). 0 runs until the duration ends.")
+	isaName := flag.String("isa", vm.DefaultISAName, fmt.Sprintf("Instruction set to run %v.", vm.ISANames()))
+	schedule := flag.String("schedule", PolicyRandom, fmt.Sprintf("Scheduling policy %v. Ignored in deterministic mode.", SchedulePolicies))
+	workers := flag.Int("workers", 0, "Number of workers for the pooled scheduling policies. 0 uses GOMAXPROCS.")
+	shards := flag.Int("shards", 0, "Shards per side of the soup for -schedule sharded. 0 picks one that keeps every worker busy.")
+	memoryModel := flag.String("memory", vm.MemoryRacy, fmt.Sprintf("Memory consistency model for soup accesses %v.", vm.MemoryModels))
+	ipLifetime := flag.Int64("ip-lifetime", 0, "Steps an IP executes before it dies. 0 makes IPs immortal.")
+	respawn := flag.Bool("respawn", false, "Replace every IP that dies with a new one at a random location. Requires -ip-lifetime.")
+	spawnOp := flag.String("spawn-op", "", "ALU op (e.g. CPY) whose execution releases a new IP at the jump address. Empty disables spawning.")
+	maxIPs := flag.Int("max-ips", 0, "Hard cap on the population for spawned IPs. 0 means no cap.")
+	var seedPrograms seedProgramFlags
+	flag.Var(&seedPrograms, "seed-program", "Assembler file to place in a new soup, as file.asm@x,y. May be repeated.")
+	configFlags := registerConfigFlags(flag.CommandLine)
+	dumpConfig := flag.Bool("dump-config", false, "Print the resolved run parameters as JSON and exit.")
+	headless := flag.Bool("headless", false, "Run without the web server and visualization, printing progress to stdout. For batch experiments.")
+	progressInterval := flag.Int("progress", 10, "In headless mode, seconds between progress lines. 0 disables them.")
+	addr := flag.String("addr", ":8080", "Address the web server listens on.")
+	lineageFilename := flag.String("lineage", "", "Write the lineage of the motifs found in the soup to this file, as .json, .dot or .graphml.")
 	flag.Parse()
 
+	cfg, err := configFlags.resolve(flag.CommandLine)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if *dumpConfig {
+		data, _ := json.MarshalIndent(cfg, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	fmt.Println("--- EvoSoup: A Go-based Artificial Life Simulation ---")
+
 	// --- 1. Initialize AppState ---
-	appState := NewAppState()
+	appState := NewAppState(cfg)
+	appState.Deterministic = *deterministic
+	appState.roundLimit = *rounds
+	if err := appState.SetISA(*isaName); err != nil {
+		log.Fatalf("Invalid -isa: %v", err)
+	}
+	if err := appState.SetSchedule(*schedule, *workers); err != nil {
+		log.Fatalf("Invalid -schedule: %v", err)
+	}
+	appState.Shards = *shards
+	if err := appState.SetPopulationDynamics(*ipLifetime, *respawn, *maxIPs); err != nil {
+		log.Fatalf("Invalid population dynamics: %v", err)
+	}
+	if err := appState.SetSpawnOp(*spawnOp); err != nil {
+		log.Fatalf("Invalid -spawn-op: %v", err)
+	}
+	if err := appState.SetMemoryModel(*memoryModel); err != nil {
+		log.Fatalf("Invalid -memory: %v", err)
+	}
+
+	// The motif analyzer is created before the server, which serves its lineage.
+	motifs := NewMotifAnalyzer(appState)
+	if *lineageFilename != "" {
+		if _, err := lineageFormat(*lineageFilename); err != nil {
+			log.Fatalf("Invalid -lineage: %v", err)
+		}
+		motifs.LineageFile = *lineageFilename
+	}
 
-	// --- 2. Create and run the WebSocket hub ---
-	hub := NewHub()
-	go hub.Run()
+	// --- 2. Create and run the WebSocket hub, unless headless ---
+	var hub *Hub
+	if !*headless {
+		hub = NewHub()
+		go hub.Run()
 
-	// --- 3. Start the web server ---
-	go StartServer(hub, appState)
+		// --- 3. Start the web server ---
+		go StartServer(hub, appState, motifs, *addr)
+	}
 
 	// --- 4. Initialize Simulation ---
 	if *loadFilename != "" {
 		// Load from snapshot
+		if len(seedPrograms) > 0 {
+			log.Fatalf("-seed-program only applies to new simulations, not to -load")
+		}
 		if err := appState.loadSnapshot(*loadFilename); err != nil {
 			log.Fatalf("Failed to load snapshot: %v", err)
 		}
@@ -71,40 +179,71 @@ func main() {
 
 	} else {
 		// --- Initialize new simulation ---
-		appState.initializeSimulation()
+		appState.initializeSimulation(*seed)
+		if err := appState.placeSeedPrograms(seedPrograms); err != nil {
+			log.Fatalf("Failed to place seed programs: %v", err)
+		}
 	}
 
-	// --- Global Jump Timer Goroutine ---
-	go appState.runCosmicRaySimulator()
-
-	// --- 5. Launch IPs ---
+	// --- 5. Launch IPs and the cosmic ray simulator ---
 	appState.LaunchIPs()
 
 	// --- 6. Real-time Visualization Goroutine ---
-	go appState.RunVisualization(hub)
-
-
-	go appState.RunStatistics(hub)
+	if hub != nil {
+		go appState.RunVisualization(hub)
+	} else if *progressInterval > 0 {
+		appState.OnStats(progressPrinter(*progressInterval))
+	}
 
 	// --- Snapshotting goroutine ---
-	go func() {
-		ticker := time.NewTicker(time.Second * 600)
-		var nSaves = 0
-		for range ticker.C {
-			nSaves++
-			var snapshotFilenameWithCount = ""
-			if *experimentDuration < 0 {
-				snapshotFilenameWithCount = fmt.Sprintf("%s_%d.gob", *snapshotFilename, 0)
-			} else {
-				snapshotFilenameWithCount = fmt.Sprintf("%s_%d.gob", *snapshotFilename, nSaves)
+	snapshotter, err := NewSnapshotter(appState, *snapshotFilename)
+	if err != nil {
+		log.Fatalf("Failed to set up snapshots: %v", err)
+	}
+	if hub != nil {
+		snapshotter.OnSave = func(filename, reason string) {
+			jsonData, err := json.Marshal(SnapshotSavedMessage{Type: "snapshot_saved", File: filename, Reason: reason})
+			if err != nil {
+				log.Printf("error marshalling snapshot message: %v", err)
+				return
 			}
-			if err := appState.saveSnapshot(snapshotFilenameWithCount); err != nil {
-				fmt.Printf(" (Error saving snapshot: %v)\n", err)
-			} else {
-				fmt.Printf(" (Snapshot %d saved to %s)\n", nSaves, snapshotFilenameWithCount)
+			hub.Broadcast <- jsonData
+		}
+	}
+	appState.OnStats(snapshotter.ObserveStats)
+	go snapshotter.Run()
+
+	// --- Metrics files ---
+	var metrics []*MetricsWriter
+	for _, filename := range []string{*metricsFilename, *entropyFilename} {
+		if filename == "" {
+			continue
+		}
+		m, err := OpenMetrics(filename, time.Duration(*metricsFlush)*time.Second)
+		if err != nil {
+			log.Fatalf("Failed to set up metrics: %v", err)
+		}
+		appState.OnStats(m.Observe)
+		metrics = append(metrics, m)
+	}
+	closeMetrics := func() {
+		for _, m := range metrics {
+			if err := m.Close(); err != nil {
+				log.Printf("Error closing metrics: %v", err)
 			}
 		}
-	}()
+	}
+
+	go appState.RunStatistics(hub)
+
+	// --- Timeline goroutine, for rewinding the run from the frontend ---
+	timeline := NewTimeline(appState)
+	if hub != nil {
+		go timeline.Run()
+	}
+
+	// --- Motif analysis goroutine, looking for replicators ---
+	go motifs.Run(hub)
 
 	// --- 7. Main Simulation Control Loop ---
 	var experimentTimer <-chan time.Time
@@ -115,25 +254,88 @@ func main() {
 		log.Println("Negative experiment duration provided, running forever.")
 	}
 
+	// The frontend's channels stay nil, and never fire, in headless mode.
+	var (
+		pauseRequests    <-chan bool
+		snapshotRequests <-chan struct{}
+		cosmicRayRates   <-chan float64
+		timelineRequests <-chan TimeTravelRequest
+	)
+	if hub != nil {
+		pauseRequests = hub.Pause
+		snapshotRequests = hub.SaveSnapshot
+		cosmicRayRates = hub.SetCosmicRayRate
+		timelineRequests = hub.TimeTravel
+	}
+
+	// finish stops the run for good, writes out the metrics and saves the
+	// final snapshot.
+	finish := func() {
+		appState.Stop()
+		closeMetrics()
+		motifs.ExportLineage()
+		if err := appState.saveSnapshot(*snapshotFilename); err != nil {
+			log.Fatalf("failed to save final snapshot: %v", err)
+		}
+		log.Printf("--- Experiment finished. Snapshot saved to %s. ---\n", *snapshotFilename)
+	}
+
+	// The first SIGINT or SIGTERM ends the run like the end of its duration,
+	// a second one exits at once.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
 	for {
 		select {
-		case isPaused := <-hub.Pause:
+		case isPaused := <-pauseRequests:
 			if isPaused {
 				appState.Pause()
+				broadcastDebugState(hub, appState, "")
 			} else {
 				appState.Resume()
 			}
-		case cosmicRayRate := <-hub.SetCosmicRayRate:
+		case reason := <-appState.debugger.Hits():
+			log.Printf("Debugger: %s", reason)
+			appState.Pause()
+			broadcastDebugState(hub, appState, reason)
+		case <-snapshotRequests:
+			snapshotter.Request(SnapshotManual)
+		case req := <-timelineRequests:
+			handleTimeTravel(hub, appState, timeline, req)
+		case cosmicRayRate := <-cosmicRayRates:
 			appState.SetCosmicRayRate(cosmicRayRate)
 		case <-experimentTimer:
 			log.Println("Experiment duration finished.")
-			// --- 8. Save final state and entropies ---
-			if err := appState.saveSnapshot(*snapshotFilename); err != nil {
-				log.Fatalf("failed to save final snapshot: %v", err)
-			}
-			log.Printf("--- Experiment finished. Snapshot saved to %s. ---\n", *snapshotFilename)
+			// --- 8. Save final state and metrics ---
+			finish()
 			return // Exit main
+		case <-appState.Finished():
+			log.Printf("Deterministic run finished after %d rounds.", *rounds)
+			finish()
+			return
+		case sig := <-signals:
+			log.Printf("Received %v, stopping. Send it again to exit without saving.", sig)
+			go func() {
+				sig := <-signals
+				log.Printf("Received %v again, exiting without saving.", sig)
+				os.Exit(1)
+			}()
+			finish()
+			return
 		}
 	}
 }
 
+// progressPrinter returns a statistics listener that prints every n-th report,
+// which is one line every n seconds.
+func progressPrinter(n int) func(GenerationStats) {
+	reports := 0
+	return func(stats GenerationStats) {
+		reports++
+		if reports%n != 0 {
+			return
+		}
+		fmt.Printf("%s  IPs: %d  Steps/sec: %d  Entropy: %.3f  Births/sec: %d  Deaths/sec: %d\n",
+			stats.Generation, stats.Population, stats.StepsPerSecond, stats.Entropy, stats.Births, stats.Deaths)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsWriter appends every statistics report to a file, as CSV or as JSON
+// lines depending on the file extension. Files are opened for appending, so a
+// run continued with -load adds to the file of the run it continues. CSV
+// columns are named after the JSON fields of GenerationStats; when appending,
+// the columns of the existing header are kept.
+type MetricsWriter struct {
+	mu        sync.Mutex
+	file      *os.File
+	buf       *bufio.Writer
+	csv       *csv.Writer // Nil for JSON lines
+	columns   []string    // CSV columns in file order
+	interval  time.Duration
+	lastFlush time.Time
+	closed    bool
+}
+
+// Metrics file formats.
+const (
+	MetricsCSV   = "csv"
+	MetricsJSONL = "jsonl"
+)
+
+// metricsFormat returns the format of a metrics file from its extension.
+func metricsFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jsonl", ".ndjson":
+		return MetricsJSONL
+	default:
+		return MetricsCSV
+	}
+}
+
+// OpenMetrics opens a metrics file for appending, creating it if needed. The
+// buffered reports are written out at least every flush interval.
+func OpenMetrics(filename string, flush time.Duration) (*MetricsWriter, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metrics file: %w", err)
+	}
+	existing, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read metrics file: %w", err)
+	}
+
+	m := &MetricsWriter{file: file, buf: bufio.NewWriter(file), interval: flush, lastFlush: time.Now()}
+	// A run that was killed may have left half a line.
+	if len(existing) > 0 && existing[len(existing)-1] != '\n' {
+		m.buf.WriteByte('\n')
+	}
+	if metricsFormat(filename) == MetricsCSV {
+		m.csv = csv.NewWriter(m.buf)
+		m.columns = statsColumns()
+		if len(existing) > 0 {
+			header, err := csv.NewReader(bytes.NewReader(existing)).Read()
+			if err != nil {
+				file.Close()
+				return nil, fmt.Errorf("failed to read the header of metrics file %s: %w", filename, err)
+			}
+			if !reflect.DeepEqual(header, m.columns) {
+				log.Printf("Metrics file %s has columns %v, writing only those.", filename, header)
+			}
+			m.columns = header
+		} else if err := m.csv.Write(m.columns); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to write metrics header: %w", err)
+		}
+	}
+	return m, nil
+}
+
+// Observe appends a report. It is meant to be registered with OnStats.
+func (m *MetricsWriter) Observe(stats GenerationStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	if err := m.write(stats); err != nil {
+		log.Printf("Error writing metrics: %v", err)
+		return
+	}
+	if time.Since(m.lastFlush) >= m.interval {
+		if err := m.flush(); err != nil {
+			log.Printf("Error flushing metrics: %v", err)
+		}
+	}
+}
+
+func (m *MetricsWriter) write(stats GenerationStats) error {
+	if m.csv == nil {
+		data, err := json.Marshal(stats)
+		if err != nil {
+			return err
+		}
+		m.buf.Write(data)
+		return m.buf.WriteByte('\n')
+	}
+	values := statsValues(stats)
+	record := make([]string, len(m.columns))
+	for i, column := range m.columns {
+		record[i] = values[column]
+	}
+	return m.csv.Write(record)
+}
+
+func (m *MetricsWriter) flush() error {
+	m.lastFlush = time.Now()
+	if m.csv != nil {
+		m.csv.Flush()
+		if err := m.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return m.buf.Flush()
+}
+
+// Close writes out the buffered reports and closes the file.
+func (m *MetricsWriter) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	if err := m.flush(); err != nil {
+		m.file.Close()
+		return fmt.Errorf("failed to flush metrics: %w", err)
+	}
+	if err := m.file.Close(); err != nil {
+		return fmt.Errorf("failed to close metrics file: %w", err)
+	}
+	return nil
+}
+
+// statsColumns returns the JSON names of the GenerationStats fields.
+func statsColumns() []string {
+	t := reflect.TypeOf(GenerationStats{})
+	columns := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		columns = append(columns, jsonName(t.Field(i)))
+	}
+	return columns
+}
+
+// statsValues formats the fields of a report by JSON name. Fields that are
+// not plain values are encoded as JSON.
+func statsValues(stats GenerationStats) map[string]string {
+	v := reflect.ValueOf(stats)
+	values := make(map[string]string, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		var s string
+		switch f.Kind() {
+		case reflect.String:
+			s = f.String()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			s = strconv.FormatInt(f.Int(), 10)
+		case reflect.Float32, reflect.Float64:
+			s = strconv.FormatFloat(f.Float(), 'g', -1, 64)
+		case reflect.Bool:
+			s = strconv.FormatBool(f.Bool())
+		case reflect.Slice, reflect.Map:
+			if f.Len() > 0 {
+				data, _ := json.Marshal(f.Interface())
+				s = string(data)
+			}
+		case reflect.Ptr:
+			if !f.IsNil() {
+				data, _ := json.Marshal(f.Interface())
+				s = string(data)
+			}
+		default:
+			data, _ := json.Marshal(f.Interface())
+			s = string(data)
+		}
+		values[jsonName(v.Type().Field(i))] = s
+	}
+	return values
+}
+
+// jsonName returns the name a struct field is encoded under.
+func jsonName(f reflect.StructField) string {
+	if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); name != "" {
+		return name
+	}
+	return f.Name
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testStats() []GenerationStats {
+	return []GenerationStats{
+		{Generation: "00:00:01", Population: 100, StepsPerSecond: 5000, Entropy: 7.25},
+		{Generation: "00:00:02", Population: 101, StepsPerSecond: 5100, Entropy: 7.5, BlockEntropies: []float64{7, 8}, Births: 1,
+			StaticMix: &InstructionMix{Total: 4, Ops: []int{1, 3}}},
+	}
+}
+
+// writeMetrics appends reports to a metrics file.
+func writeMetrics(t *testing.T, filename string, reports []GenerationStats) {
+	t.Helper()
+	m, err := OpenMetrics(filename, 0)
+	if err != nil {
+		t.Fatalf("OpenMetrics: %v", err)
+	}
+	for _, stats := range reports {
+		m.Observe(stats)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestMetricsCSV(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "metrics.csv")
+	reports := testStats()
+	writeMetrics(t, filename, reports[:1])
+	writeMetrics(t, filename, reports[1:])
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || !reflect.DeepEqual(records[0], statsColumns()) {
+		t.Fatalf("got %d records with header %v, want a header and 2 rows", len(records), records[0])
+	}
+	row := make(map[string]string)
+	for i, column := range records[0] {
+		row[column] = records[2][i]
+	}
+	want := map[string]string{
+		"Generation":     "00:00:02",
+		"Population":     "101",
+		"Entropy":        "7.5",
+		"BlockEntropies": "[7,8]",
+		"Births":         "1",
+		"DynamicMix":     "",
+	}
+	for column, value := range want {
+		if row[column] != value {
+			t.Errorf("column %s is %q, want %q", column, row[column], value)
+		}
+	}
+	var mix InstructionMix
+	if err := json.Unmarshal([]byte(row["StaticMix"]), &mix); err != nil || mix.Total != 4 {
+		t.Errorf("column StaticMix is %q, want the JSON of the mix", row["StaticMix"])
+	}
+}
+
+func TestMetricsCSVKeepsExistingColumns(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "metrics.csv")
+	// A header of an older version, and a row cut off by a crash.
+	if err := os.WriteFile(filename, []byte("Generation,Entropy\n00:00:00,7\n00:00:0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeMetrics(t, filename, testStats()[:1])
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Generation,Entropy\n00:00:00,7\n00:00:0\n00:00:01,7.25\n"; string(data) != want {
+		t.Errorf("file holds %q, want %q", data, want)
+	}
+}
+
+func TestMetricsJSONL(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "metrics.jsonl")
+	reports := testStats()
+	writeMetrics(t, filename, reports[:1])
+	writeMetrics(t, filename, reports[1:])
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var got []GenerationStats
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var stats GenerationStats
+		if err := json.Unmarshal(scanner.Bytes(), &stats); err != nil {
+			t.Fatalf("line %d: %v", len(got)+1, err)
+		}
+		got = append(got, stats)
+	}
+	if !reflect.DeepEqual(got, reports) {
+		t.Errorf("read back %+v, want %+v", got, reports)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"evolution/vm"
+)
+
+// InstructionMix counts instructions by their decoded fields.
+type InstructionMix struct {
+	Total int    `json:"total"`
+	Ops   []int  `json:"ops"`   // By ALU op value, see the opcodes of the ISA
+	S1Ptr int    `json:"s1Ptr"` // Instructions reading Src1 through a pointer, the others read its value
+	S2Ptr int    `json:"s2Ptr"` // Likewise for Src2
+	Dest  [4]int `json:"dest"`  // By destination selector: Src1, Src2, self, jump address
+}
+
+func newInstructionMix(isa vm.ISA) *InstructionMix {
+	return &InstructionMix{Ops: make([]int, 1<<isa.OpBits())}
+}
+
+// add counts n instructions decoded as d.
+func (m *InstructionMix) add(d vm.Decoded, n int) {
+	m.Total += n
+	if int(d.Op) < len(m.Ops) {
+		m.Ops[d.Op] += n
+	}
+	if d.S1Ptr {
+		m.S1Ptr += n
+	}
+	if d.S2Ptr {
+		m.S2Ptr += n
+	}
+	m.Dest[d.Dest&3] += n
+}
+
+// soupMix returns the static instruction mix, every byte of the soup decoded
+// as an instruction. Like soupEntropies, it reads the soup while the IPs run.
+func (s *AppState) soupMix() *InstructionMix {
+	var counts vm.OpCounts
+	for _, v := range s.soup {
+		counts[uint8(v)]++
+	}
+	return s.decodeMix(&counts)
+}
+
+// decodeMix turns counts by instruction byte into an instruction mix.
+func (s *AppState) decodeMix(counts *vm.OpCounts) *InstructionMix {
+	mix := newInstructionMix(s.isa)
+	for v, n := range counts {
+		if n > 0 {
+			mix.add(s.isa.Decode(uint8(v)), int(n))
+		}
+	}
+	return mix
+}
+
+// opCounters sums the instructions executed by the scheduler goroutines. Each
+// goroutine counts into its own vm.OpCounts, so a step costs one increment
+// and no synchronization.
+type opCounters struct {
+	mu      sync.Mutex
+	live    map[*vm.OpCounts]bool
+	retired vm.OpCounts // Counts of the goroutines that have ended
+}
+
+// startCounting returns the counts for a new scheduler goroutine, or nil when
+// the instruction mix is disabled. The goroutine hands them back with
+// stopCounting.
+func (s *AppState) startCounting() *vm.OpCounts {
+	if s.config.MixInterval <= 0 {
+		return nil
+	}
+	c := &s.opCounters
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.live == nil {
+		c.live = make(map[*vm.OpCounts]bool)
+	}
+	counts := new(vm.OpCounts)
+	c.live[counts] = true
+	return counts
+}
+
+// stopCounting adds the counts of a scheduler goroutine that ends to the
+// total.
+func (s *AppState) stopCounting(counts *vm.OpCounts) {
+	if counts == nil {
+		return
+	}
+	c := &s.opCounters
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, n := range counts {
+		c.retired[i] += n
+	}
+	delete(c.live, counts)
+}
+
+// executedOps returns the instructions executed so far. The counts of running
+// goroutines are read while they change, like the soup for the statistics.
+func (s *AppState) executedOps() vm.OpCounts {
+	c := &s.opCounters
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	total := c.retired
+	for counts := range c.live {
+		for i, n := range counts {
+			total[i] += n
+		}
+	}
+	return total
+}
+
+// mixSampler hands out the static mix and the dynamic mix, the instructions
+// executed since the previous mixes, once per interval.
+type mixSampler struct {
+	executed vm.OpCounts // Executed instructions as of the previous mixes
+	last     time.Time
+}
+
+// sample returns the mixes once the interval has passed since the previous
+// ones, and nils otherwise or if the interval is 0.
+func (m *mixSampler) sample(s *AppState, interval time.Duration) (static, dynamic *InstructionMix) {
+	if interval <= 0 || time.Since(m.last) < interval {
+		return nil, nil
+	}
+	m.last = time.Now()
+	executed := s.executedOps()
+	var delta vm.OpCounts
+	for i, n := range executed {
+		delta[i] = n - m.executed[i]
+	}
+	m.executed = executed
+	return s.soupMix(), s.decodeMix(&delta)
+}
+
+// broadcastInstructionMix sends the mixes of a report to the frontend.
+func broadcastInstructionMix(hub *Hub, s *AppState, generation string, static, dynamic *InstructionMix) {
+	jsonData, err := json.Marshal(InstructionMixMessage{
+		Type:       "instruction_mix",
+		Generation: generation,
+		Opcodes:    s.isa.Opcodes(),
+		Static:     static,
+		Dynamic:    dynamic,
+	})
+	if err != nil {
+		log.Printf("error marshalling instruction mix: %v", err)
+		return
+	}
+	hub.Broadcast <- jsonData
+}
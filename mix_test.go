@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"evolution/vm"
+)
+
+func TestDecodeMix(t *testing.T) {
+	s := newTestAppState(t, 1, nil)
+	var counts vm.OpCounts
+	counts[0x00] = 3 // Op 0, both sources direct, destination Src1
+	counts[0x1D] = 2 // Op 1, both sources through pointers, destination Src2
+	counts[0xF7] = 1 // Op 15, Src2 through a pointer, destination the jump address
+	want := &InstructionMix{Total: 6, Ops: make([]int, 16), S1Ptr: 2, S2Ptr: 3, Dest: [4]int{3, 2, 0, 1}}
+	want.Ops[0], want.Ops[1], want.Ops[15] = 3, 2, 1
+	if got := s.decodeMix(&counts); !reflect.DeepEqual(got, want) {
+		t.Errorf("decodeMix = %+v, want %+v", got, want)
+	}
+
+	for i := range s.soup {
+		s.soup[i] = int8(i)
+	}
+	if got := s.soupMix(); got.Total != len(s.soup) || got.S1Ptr != len(s.soup)/2 || got.Dest[3] != len(s.soup)/4 {
+		t.Errorf("soupMix of every byte value = %+v", got)
+	}
+}
+
+func TestOpCounters(t *testing.T) {
+	s := newTestAppState(t, 1, nil)
+	a, b := s.startCounting(), s.startCounting()
+	a[1], b[1], b[2] = 5, 7, 1
+	s.stopCounting(a)
+	a[1] = 100 // Retired tables no longer count
+	got := s.executedOps()
+	if got[1] != 12 || got[2] != 1 {
+		t.Errorf("executed %d and %d, want 12 and 1", got[1], got[2])
+	}
+	s.stopCounting(b)
+	if again := s.executedOps(); again != got {
+		t.Error("retiring a table changed the total")
+	}
+
+	s.config.MixInterval = 0
+	if counts := s.startCounting(); counts != nil {
+		t.Error("counting with the instruction mix disabled")
+	}
+}
+
+func TestPausedStepsAreCounted(t *testing.T) {
+	s := newTestAppState(t, 1, nil)
+	// The tables of a scheduler that ran before the pause are retired.
+	counts := s.startCounting()
+	s.population.Range(func(key, value interface{}) bool {
+		value.(*vm.IP).Counts = counts
+		return true
+	})
+	s.stopCounting(counts)
+	atomic.StoreInt32(&s.paused, 1)
+
+	total := func() int64 {
+		executed := s.executedOps()
+		var n int64
+		for _, c := range executed {
+			n += c
+		}
+		return n
+	}
+	s.Step()
+	if got, want := total(), int64(s.config.NumIPs()); got != want {
+		t.Errorf("counted %d instructions after a step, want one for each of the %d IPs", got, want)
+	}
+	s.StepIP(1)
+	if got, want := total(), int64(s.config.NumIPs()+1); got != want {
+		t.Errorf("counted %d instructions after stepping one IP, want %d", got, want)
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"evolution/vm"
+)
+
+// Motif is a segment of a soup row that occurs several times, the trace a
+// replicator leaves as it copies itself.
+type Motif struct {
+	Cells     []int8          `json:"cells"`
+	Count     int             `json:"count"`     // Occurrences, overlapping ones included
+	Locations []MotifLocation `json:"locations"` // The first maxMotifLocations, in soup order
+
+	// Tracking across analyses, see MotifTracker
+	ID        int     `json:"id"`        // Node of the motif in the lineage
+	Parent    int     `json:"parent"`    // Node of its closest earlier motif, -1 for none
+	FirstSeen float64 `json:"firstSeen"` // Seconds of run time
+	PeakCount int     `json:"peakCount"`
+	PeakAt    float64 `json:"peakAt"`
+}
+
+// MotifLocation is the soup coordinate of the first cell of an occurrence.
+type MotifLocation struct {
+	X int32 `json:"x"`
+	Y int32 `json:"y"`
+}
+
+// MotifOptions select what FindMotifs reports.
+type MotifOptions struct {
+	Length   int // Cells per motif
+	MinCount int // Fewest occurrences of a motif
+	Top      int // Most motifs reported
+}
+
+// Validate checks that the options describe a search FindMotifs can run.
+func (o MotifOptions) Validate() error {
+	if o.Length < 2 {
+		return fmt.Errorf("motifLength must be at least 2, got %d", o.Length)
+	}
+	if o.MinCount < 2 {
+		return fmt.Errorf("motifMinCount must be at least 2, got %d", o.MinCount)
+	}
+	if o.Top < 1 {
+		return fmt.Errorf("motifTop must be at least 1, got %d", o.Top)
+	}
+	return nil
+}
+
+const (
+	maxMotifKeys      = 1 << 20 // Distinct segments counted at most, see FindMotifs
+	maxMotifLocations = 256
+	motifHashBase     = 1099511628211
+)
+
+// FindMotifs returns the most abundant row segments of the soup, most abundant
+// first. Segments of a single repeated value are not motifs. To bound memory,
+// a soup of more than maxMotifKeys cells only counts the segments whose hash
+// falls in a fixed fraction; a motif is either always counted or never, and a
+// copied program longer than the motif length still shows through the
+// segments of it that are. Overlapping segments of the same longer program
+// are reported once, by the most abundant of them.
+func FindMotifs(soup []int8, dimX int32, opts MotifOptions) []Motif {
+	stride := uint64((len(soup) + maxMotifKeys - 1) / maxMotifKeys)
+	counts := make(map[uint64]int)
+	scanSegments(soup, dimX, opts.Length, func(pos int, h uint64) {
+		if h%stride == 0 {
+			counts[h]++
+		}
+	})
+
+	// Rank the candidates, with room for the ones dropped as overlapping.
+	var keys []uint64
+	for h, n := range counts {
+		if n >= opts.MinCount {
+			keys = append(keys, h)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > opts.Top*8 {
+		keys = keys[:opts.Top*8]
+	}
+
+	candidates := make(map[uint64]*Motif, len(keys))
+	for _, h := range keys {
+		candidates[h] = &Motif{Count: counts[h]}
+	}
+	scanSegments(soup, dimX, opts.Length, func(pos int, h uint64) {
+		m := candidates[h]
+		if m == nil || len(m.Locations) >= maxMotifLocations {
+			return
+		}
+		if m.Cells == nil {
+			m.Cells = append([]int8(nil), soup[pos:pos+opts.Length]...)
+		}
+		m.Locations = append(m.Locations, MotifLocation{X: int32(pos) % dimX, Y: int32(pos) / dimX})
+	})
+
+	// A motif is part of a better one if most of its occurrences overlap it.
+	var motifs []Motif
+	covered := make(map[int]bool)
+	for _, h := range keys {
+		m := candidates[h]
+		overlapping := 0
+		for _, l := range m.Locations {
+			if covered[int(l.Y)*int(dimX)+int(l.X)] {
+				overlapping++
+			}
+		}
+		if 2*overlapping > len(m.Locations) {
+			continue
+		}
+		for _, l := range m.Locations {
+			pos := int(l.Y)*int(dimX) + int(l.X)
+			for d := -opts.Length + 1; d < opts.Length; d++ {
+				covered[pos+d] = true
+			}
+		}
+		motifs = append(motifs, *m)
+		if len(motifs) == opts.Top {
+			break
+		}
+	}
+	return motifs
+}
+
+// scanSegments calls fn with the position and hash of every segment of the
+// given length that lies within a row and is not mostly one value, like the
+// runs of a single instruction that fill an evolved soup.
+func scanSegments(soup []int8, dimX int32, length int, fn func(pos int, h uint64)) {
+	width := int(dimX)
+	var pow uint64 = 1 // motifHashBase^(length-1)
+	for i := 1; i < length; i++ {
+		pow *= motifHashBase
+	}
+	for y := 0; y < len(soup)/width; y++ {
+		row := soup[y*width : (y+1)*width]
+		var h uint64
+		var counts [256]int // Of the values in the segment
+		dominated := 0      // Values filling more than half the segment, 0 or 1
+		for i, v := range row {
+			if i >= length {
+				old := uint8(row[i-length])
+				h -= (uint64(old) + 1) * pow
+				if counts[old]--; 2*counts[old] == length || 2*counts[old]+1 == length {
+					dominated--
+				}
+			}
+			h = h*motifHashBase + uint64(uint8(v)) + 1
+			if counts[uint8(v)]++; 2*counts[uint8(v)] == length+1 || 2*counts[uint8(v)] == length+2 {
+				dominated++
+			}
+			if i >= length-1 && dominated == 0 {
+				fn(y*width+i-length+1, mixHash(h))
+			}
+		}
+	}
+}
+
+// mixHash scrambles the bits of a rolling hash, whose low bits only depend on
+// the low bits of the cells, so that any of them can be used for sampling.
+func mixHash(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	return h ^ h>>31
+}
+
+// MotifTracker remembers the motifs found over a run, to tell when each was
+// first seen, how abundant it has been and which motif it descends from.
+type MotifTracker struct {
+	mu     sync.Mutex
+	nodes  []*LineageNode          // In order of first sighting
+	seen   map[string]*LineageNode // By cells
+	nextID int
+}
+
+// NewMotifTracker creates a tracker that has seen no motifs.
+func NewMotifTracker() *MotifTracker {
+	return &MotifTracker{seen: make(map[string]*LineageNode)}
+}
+
+// Observe records the motifs found at the given run time and fills in their
+// tracking fields. A motif seen for the first time descends from the closest
+// motif, by edit distance, of the earlier observations.
+func (t *MotifTracker) Observe(motifs []Motif, elapsed time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seconds := elapsed.Seconds()
+	earlier := t.nodes
+	for i := range motifs {
+		m := &motifs[i]
+		key := motifKey(m.Cells)
+		n := t.seen[key]
+		if n == nil {
+			n = &LineageNode{ID: t.nextID, Cells: m.Cells, Parent: -1, FirstSeen: seconds}
+			t.nextID++
+			for _, e := range earlier {
+				if d := editDistance(m.Cells, e.Cells); n.Parent < 0 || d < n.Distance {
+					n.Parent, n.Distance = e.ID, d
+				}
+			}
+			t.nodes = append(t.nodes, n)
+			t.seen[key] = n
+		}
+		n.LastSeen = seconds
+		if m.Count > n.PeakCount {
+			n.PeakCount = m.Count
+			n.PeakAt = seconds
+		}
+		m.ID, m.Parent = n.ID, n.Parent
+		m.FirstSeen, m.PeakCount, m.PeakAt = n.FirstSeen, n.PeakCount, n.PeakAt
+	}
+}
+
+// Lineage returns a copy of the lineage of the motifs seen so far.
+func (t *MotifTracker) Lineage() []LineageNode {
+	nodes, _ := t.Save()
+	return nodes
+}
+
+// Save returns a copy of the lineage along with the ID the next new motif
+// will get, for Restore.
+func (t *MotifTracker) Save() ([]LineageNode, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	nodes := make([]LineageNode, len(t.nodes))
+	for i, n := range t.nodes {
+		nodes[i] = *n
+	}
+	return nodes, t.nextID
+}
+
+// checkLineage reports whether a lineage returned by Save is consistent: IDs
+// are unique and below nextID, and parents come before their descendants.
+func checkLineage(nodes []LineageNode, nextID int) error {
+	ids := make(map[int]bool, len(nodes))
+	for _, n := range nodes {
+		if n.ID < 0 || n.ID >= nextID || ids[n.ID] {
+			return fmt.Errorf("motif %d has an invalid or duplicate ID", n.ID)
+		}
+		if n.Parent >= 0 && !ids[n.Parent] {
+			return fmt.Errorf("motif %d descends from unknown motif %d", n.ID, n.Parent)
+		}
+		ids[n.ID] = true
+	}
+	return nil
+}
+
+// Restore replaces the lineage with one returned by Save, so a loaded run
+// keeps growing the tree it had. The lineage must pass checkLineage.
+func (t *MotifTracker) Restore(nodes []LineageNode, nextID int) {
+	restored := make([]*LineageNode, len(nodes))
+	seen := make(map[string]*LineageNode, len(nodes))
+	for i := range nodes {
+		n := nodes[i]
+		restored[i] = &n
+		seen[motifKey(n.Cells)] = &n
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nodes, t.seen, t.nextID = restored, seen, nextID
+}
+
+func motifKey(cells []int8) string {
+	key := make([]byte, len(cells))
+	for i, v := range cells {
+		key[i] = byte(v)
+	}
+	return string(key)
+}
+
+// MotifAnalyzer looks for motifs in the running soup at an interval and
+// tracks them in the run's lineage, which snapshots save and restore.
+type MotifAnalyzer struct {
+	appState    *AppState
+	LineageFile string // Exported after every analysis when set, see exportLineage
+	exportMu    sync.Mutex
+}
+
+// NewMotifAnalyzer creates an analyzer for a run.
+func NewMotifAnalyzer(appState *AppState) *MotifAnalyzer {
+	return &MotifAnalyzer{appState: appState}
+}
+
+// Run analyzes the soup at the configured interval until the run stops,
+// broadcasting the motifs, or logging the most abundant one without a hub.
+// It returns at once if the analysis is disabled.
+func (a *MotifAnalyzer) Run(hub *Hub) {
+	s := a.appState
+	interval := s.config.MotifInterval
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		if atomic.LoadInt32(&s.paused) == 1 {
+			continue
+		}
+		elapsed := s.elapsed()
+		motifs := a.analyze(elapsed)
+		a.ExportLineage()
+		if hub == nil {
+			if len(motifs) > 0 {
+				log.Printf("Motifs at %s: %d found, the most abundant has %d copies, first seen at %s.",
+					elapsed.Round(time.Second), len(motifs), motifs[0].Count, runTime(motifs[0].FirstSeen))
+			}
+			continue
+		}
+		jsonData, err := json.Marshal(MotifsMessage{
+			Type:    "motifs",
+			Elapsed: elapsed.Seconds(),
+			Length:  s.config.MotifLength,
+			Motifs:  motifs,
+		})
+		if err != nil {
+			log.Printf("error marshalling motifs: %v", err)
+			continue
+		}
+		hub.Broadcast <- jsonData
+	}
+}
+
+// analyze finds the motifs in a copy of the soup, taken while the IPs run
+// like for the other statistics, and tracks them.
+func (a *MotifAnalyzer) analyze(elapsed time.Duration) []Motif {
+	s := a.appState
+	soup := append([]int8(nil), s.soup...)
+	motifs := FindMotifs(soup, s.soupDimX, s.config.motifOptions())
+	s.motifs.Observe(motifs, elapsed)
+	return motifs
+}
+
+// Lineage returns the lineage of the motifs found so far.
+func (a *MotifAnalyzer) Lineage() []LineageNode {
+	return a.appState.motifs.Lineage()
+}
+
+// ExportLineage writes the lineage to LineageFile, if set.
+func (a *MotifAnalyzer) ExportLineage() {
+	if a.LineageFile == "" {
+		return
+	}
+	a.exportMu.Lock()
+	defer a.exportMu.Unlock()
+	if err := exportLineage(a.LineageFile, a.Lineage()); err != nil {
+		log.Printf("Error exporting motif lineage: %v", err)
+	}
+}
+
+// motifOptions returns the motif analysis parameters of the config.
+func (c Config) motifOptions() MotifOptions {
+	return MotifOptions{Length: c.MotifLength, MinCount: c.MotifMinCount, Top: c.MotifTop}
+}
+
+// formatMotif describes a motif on two lines, its lineage, counts and cells
+// in hex, and its disassembly.
+func formatMotif(isa vm.ISA, m Motif) string {
+	length := int32(len(m.Cells))
+	origin := "new"
+	if m.Parent >= 0 {
+		origin = fmt.Sprintf("from #%d", m.Parent)
+	}
+	return fmt.Sprintf("#%d (%s) %d copies, first seen %s, peak %d at %s, first at (%d, %d): %s\n        %s",
+		m.ID, origin, m.Count, runTime(m.FirstSeen), m.PeakCount, runTime(m.PeakAt),
+		m.Locations[0].X, m.Locations[0].Y, cellsHex(m.Cells),
+		strings.TrimRight(vm.FormatDisassembly(vm.Disassemble(isa, m.Cells, length, 0, 0, length, 1)), "\n"))
+}
+
+// cellsHex renders cells as hex bytes separated by spaces.
+func cellsHex(cells []int8) string {
+	hex := make([]string, len(cells))
+	for i, v := range cells {
+		hex[i] = fmt.Sprintf("%02x", uint8(v))
+	}
+	return strings.Join(hex, " ")
+}
+
+// runTime converts seconds of run time for display.
+func runTime(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second)
+}
+
+// MotifReport is the result of the motifs subcommand for one snapshot.
+type MotifReport struct {
+	File    string  `json:"file"`
+	Elapsed float64 `json:"elapsed"` // Run time of the snapshot in seconds
+	Motifs  []Motif `json:"motifs"`
+}
+
+// motifsMain runs the motifs subcommand, which searches snapshots for motifs
+// and tracks them across the snapshots in order of run time.
+func motifsMain(args []string) {
+	fs := flag.NewFlagSet("motifs", flag.ExitOnError)
+	d := DefaultConfig()
+	length := fs.Int("length", d.MotifLength, "Cells per motif.")
+	minCount := fs.Int("min-count", d.MotifMinCount, "Fewest copies of a motif.")
+	top := fs.Int("top", d.MotifTop, "Most motifs reported per snapshot.")
+	asJSON := fs.Bool("json", false, "Print the motifs as JSON, with all their locations.")
+	lineageFile := fs.String("lineage", "", "Write the lineage of the motifs to this file, as .json, .dot or .graphml.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s motifs [flags] snapshot.gob...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	opts := MotifOptions{Length: *length, MinCount: *minCount, Top: *top}
+	if err := opts.Validate(); err != nil {
+		log.Fatalf("Invalid motif search: %v", err)
+	}
+	if *lineageFile != "" {
+		if _, err := lineageFormat(*lineageFile); err != nil {
+			log.Fatalf("Invalid -lineage: %v", err)
+		}
+	}
+
+	type snapshot struct {
+		file  string
+		state SimulationState
+	}
+	var snapshots []snapshot
+	for _, file := range fs.Args() {
+		state, err := readSnapshot(file)
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", file, err)
+		}
+		if state.Config.VisDim == 0 {
+			if state.Config, err = legacyConfig(DefaultConfig(), len(state.Soup)); err != nil {
+				log.Fatalf("Failed to read %s: %v", file, err)
+			}
+		}
+		snapshots = append(snapshots, snapshot{file, state})
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].state.TimeElapsed < snapshots[j].state.TimeElapsed
+	})
+
+	tracker := NewMotifTracker()
+	var reports []MotifReport
+	for _, snap := range snapshots {
+		elapsed := time.Duration(snap.state.TimeElapsed) * time.Microsecond
+		motifs := FindMotifs(snap.state.Soup, snap.state.Config.SoupDim(), opts)
+		tracker.Observe(motifs, elapsed)
+		if *asJSON {
+			reports = append(reports, MotifReport{File: snap.file, Elapsed: elapsed.Seconds(), Motifs: motifs})
+			continue
+		}
+		isa, err := vm.LookupISA(snap.state.ISA)
+		if err != nil {
+			isa, _ = vm.LookupISA(vm.DefaultISAName)
+		}
+		fmt.Printf("%s at %s: %d motifs\n", snap.file, elapsed.Round(time.Second), len(motifs))
+		for i, m := range motifs {
+			fmt.Printf("%3d %s\n", i+1, formatMotif(isa, m))
+		}
+	}
+	if *lineageFile != "" {
+		if err := exportLineage(*lineageFile, tracker.Lineage()); err != nil {
+			log.Fatalf("Failed to export lineage: %v", err)
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(reports); err != nil {
+			log.Fatalf("Failed to write motifs: %v", err)
+		}
+	}
+}
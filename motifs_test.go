@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindMotifs(t *testing.T) {
+	const dimX, dimY = 32, 16
+	soup := make([]int8, dimX*dimY)
+	r := rand.New(rand.NewSource(1))
+	for i := range soup {
+		soup[i] = int8(r.Intn(256))
+	}
+	place := func(cells []int8, locations ...MotifLocation) {
+		for _, l := range locations {
+			copy(soup[int(l.Y)*dimX+int(l.X):], cells)
+		}
+	}
+
+	a := []int8{1, 2, 3, 4, 5, 6}
+	aAt := []MotifLocation{{2, 1}, {10, 3}, {20, 5}, {0, 7}, {26, 9}}
+	place(a, aAt...)
+	place(a, MotifLocation{29, 11}) // Across a row end, so not an occurrence
+	b := []int8{-9, -8, -7, -6, -5, -4}
+	bAt := []MotifLocation{{12, 0}, {3, 13}, {15, 14}}
+	place(b, bAt...)
+	// A program longer than the motifs, reported once through one of its
+	// segments.
+	program := []int8{20, 21, 22, 23, 24, 25, 26, 27, 28, 29}
+	place(program, MotifLocation{0, 2}, MotifLocation{16, 4}, MotifLocation{5, 6}, MotifLocation{18, 15})
+	// Runs of one value are not motifs.
+	run := []int8{7, 7, 7, 7, 7, 7}
+	place(run, MotifLocation{8, 10}, MotifLocation{20, 10}, MotifLocation{8, 12})
+
+	motifs := FindMotifs(soup, dimX, MotifOptions{Length: 6, MinCount: 2, Top: 5})
+	if len(motifs) != 3 {
+		t.Fatalf("found %d motifs, want 3: %+v", len(motifs), motifs)
+	}
+	if got := motifs[0]; !reflect.DeepEqual(got.Cells, a) || got.Count != 5 || !reflect.DeepEqual(got.Locations, aAt) {
+		t.Errorf("first motif %+v, want %v 5 times at %v", got, a, aAt)
+	}
+	if got := motifs[1]; got.Count != 4 || len(got.Cells) != 6 || !strings.Contains(motifKey(program), motifKey(got.Cells)) {
+		t.Errorf("second motif %+v, want a segment of %v 4 times", got, program)
+	}
+	if got := motifs[2]; !reflect.DeepEqual(got.Cells, b) || got.Count != 3 || !reflect.DeepEqual(got.Locations, bAt) {
+		t.Errorf("third motif %+v, want %v 3 times at %v", got, b, bAt)
+	}
+
+	// Only the most abundant motifs are reported.
+	motifs = FindMotifs(soup, dimX, MotifOptions{Length: 6, MinCount: 4, Top: 1})
+	if len(motifs) != 1 || !reflect.DeepEqual(motifs[0].Cells, a) {
+		t.Errorf("found %+v, want only %v", motifs, a)
+	}
+}
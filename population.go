@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"evolution/vm"
+)
+
+// Population dynamics. By default the population is fixed: every IP created
+// by initializeSimulation runs forever. IPs can instead die after a number of
+// steps, be replaced by a fresh IP at a random location, and release new IPs
+// when they execute a designated ALU op, up to a hard cap.
+
+// SetPopulationDynamics configures IP lifetimes, respawning and the population
+// cap. A lifetime of 0 makes IPs immortal and a cap of 0 leaves the
+// population unbounded.
+func (s *AppState) SetPopulationDynamics(lifetime int64, respawn bool, maxIPs int) error {
+	if err := checkPopulationDynamics(lifetime, respawn, maxIPs); err != nil {
+		return err
+	}
+	s.IPLifetime = lifetime
+	s.Respawn = respawn
+	s.MaxIPs = int32(maxIPs)
+	return nil
+}
+
+// checkPopulationDynamics reports whether the population dynamics are valid.
+func checkPopulationDynamics(lifetime int64, respawn bool, maxIPs int) error {
+	if lifetime < 0 {
+		return fmt.Errorf("IP lifetime must not be negative, got %d", lifetime)
+	}
+	if maxIPs < 0 {
+		return fmt.Errorf("IP cap must not be negative, got %d", maxIPs)
+	}
+	if respawn && lifetime == 0 {
+		return fmt.Errorf("respawning requires an IP lifetime")
+	}
+	return nil
+}
+
+// SetSpawnOp designates the ALU op, by mnemonic in the active instruction set,
+// whose execution releases a new IP at the jump address. An empty name
+// disables spawning.
+func (s *AppState) SetSpawnOp(name string) error {
+	s.spawnOpName = name
+	return s.resolveSpawnOp()
+}
+
+// resolveSpawnOp looks the spawn op up in the active instruction set.
+func (s *AppState) resolveSpawnOp() error {
+	op, err := lookupSpawnOp(s.isa, s.spawnOpName)
+	s.spawnOp = op
+	return err
+}
+
+// lookupSpawnOp returns the value of the named op in an instruction set, or
+// NoSpawn for an empty name.
+func lookupSpawnOp(isa vm.ISA, name string) (int16, error) {
+	if name == "" {
+		return vm.NoSpawn, nil
+	}
+	var names []string
+	for _, op := range isa.Opcodes() {
+		if strings.EqualFold(op.Name, name) {
+			return int16(op.Value), nil
+		}
+		names = append(names, op.Name)
+	}
+	return vm.NoSpawn, fmt.Errorf("instruction set %q has no op %q (available: %v)", isa.Name(), name, names)
+}
+
+// dynamic reports whether IPs can be born or die during a run.
+func (s *AppState) dynamic() bool {
+	return s.IPLifetime > 0 || s.spawnOp != vm.NoSpawn
+}
+
+// afterStep applies the population dynamics to an IP that has just stepped.
+// It returns the IP born in the step, if any, and whether the stepping IP is
+// still alive. An IP that reaches its lifetime dies without releasing the IP
+// it spawned in its last step; a respawn counts as a death and a birth.
+func (s *AppState) afterStep(ip *vm.IP) (born *vm.IP, alive bool) {
+	if s.IPLifetime > 0 && ip.Steps >= s.IPLifetime {
+		ip.Spawn = false
+		s.killIP(ip)
+		if s.Respawn {
+			born = s.spawnIP(int32(ip.Rand.Intn(int(s.soupDimX))), int32(ip.Rand.Intn(int(s.soupDimY))))
+		}
+		return born, false
+	}
+	if ip.Spawn {
+		ip.Spawn = false
+		born = s.spawnIP(ip.SpawnX, ip.SpawnY)
+	}
+	return born, true
+}
+
+// spawnIP adds a new IP at (x, y) unless the population is at its cap. The
+// caller attaches the memory it runs with.
+func (s *AppState) spawnIP(x, y int32) *vm.IP {
+	count := atomic.AddInt32(&s.ipCount, 1)
+	if s.MaxIPs > 0 && count > s.MaxIPs {
+		atomic.AddInt32(&s.ipCount, -1)
+		return nil
+	}
+	id := atomic.AddInt32(&s.nextIPID, 1)
+	ip := s.newIP(int(id), x, y)
+	if s.debugger.Active() {
+		ip.Observer = s.debugger
+	}
+	s.population.Store(ip.ID, ip)
+	atomic.AddInt64(&s.births, 1)
+	return ip
+}
+
+// killIP removes an IP from the population, keeping its steps in the total.
+func (s *AppState) killIP(ip *vm.IP) {
+	s.population.Delete(ip.ID)
+	atomic.AddInt32(&s.ipCount, -1)
+	atomic.AddInt64(&s.deaths, 1)
+	atomic.AddInt64(&s.retiredSteps, ip.Steps)
+}
+
+// totalSteps returns the steps executed by the living and the dead IPs.
+func (s *AppState) totalSteps() int64 {
+	total := atomic.LoadInt64(&s.retiredSteps)
+	s.population.Range(func(key, value interface{}) bool {
+		total += value.(*vm.IP).Steps
+		return true
+	})
+	return total
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"evolution/vm"
+)
+
+func TestAfterStep(t *testing.T) {
+	s := newTestAppState(t, 1, func(s *AppState) {
+		if err := s.SetPopulationDynamics(10, false, 17); err != nil {
+			t.Fatal(err)
+		}
+	})
+	ip := func(id int) *vm.IP {
+		ip, ok := s.lookupIP(id)
+		if !ok {
+			t.Fatalf("IP %d not found", id)
+		}
+		return ip
+	}
+
+	// A spawn releases an IP at the jump address, up to the cap.
+	parent := ip(1)
+	parent.Spawn, parent.SpawnX, parent.SpawnY = true, 3, 4
+	born, alive := s.afterStep(parent)
+	if !alive || born == nil || born.ID != 17 || born.X != 3 || born.Y != 4 || parent.Spawn {
+		t.Fatalf("spawn gave %+v, alive %v", born, alive)
+	}
+	parent.Spawn = true
+	if born, alive := s.afterStep(parent); born != nil || !alive || parent.Spawn {
+		t.Errorf("spawn past the cap gave %+v, alive %v", born, alive)
+	}
+
+	// An IP that reaches its lifetime dies, without its last spawn.
+	old := ip(2)
+	old.Steps, old.Spawn = 10, true
+	if born, alive := s.afterStep(old); born != nil || alive {
+		t.Errorf("IP at its lifetime gave %+v, alive %v", born, alive)
+	}
+	if _, ok := s.lookupIP(2); ok {
+		t.Error("dead IP is still in the population")
+	}
+
+	// With respawning, it is replaced.
+	s.Respawn = true
+	ip(3).Steps = 10
+	if born, alive := s.afterStep(ip(3)); born == nil || born.ID != 18 || alive {
+		t.Errorf("IP at its lifetime gave %+v, alive %v, want a respawn", born, alive)
+	}
+
+	if n := atomic.LoadInt32(&s.ipCount); n != 16 {
+		t.Errorf("population of %d, want 16", n)
+	}
+	if births, deaths := atomic.LoadInt64(&s.births), atomic.LoadInt64(&s.deaths); births != 2 || deaths != 2 {
+		t.Errorf("%d births and %d deaths, want 2 and 2", births, deaths)
+	}
+	if steps := s.totalSteps(); steps != 20 {
+		t.Errorf("%d steps in total, want the 20 of the dead IPs", steps)
+	}
+}
+
+func TestCheckPopulationDynamics(t *testing.T) {
+	tests := []struct {
+		lifetime int64
+		respawn  bool
+		maxIPs   int
+		ok       bool
+	}{
+		{0, false, 0, true},
+		{1000, true, 100, true},
+		{-1, false, 0, false},
+		{0, false, -1, false},
+		{0, true, 0, false},
+	}
+	for _, tt := range tests {
+		if err := checkPopulationDynamics(tt.lifetime, tt.respawn, tt.maxIPs); (err == nil) != tt.ok {
+			t.Errorf("checkPopulationDynamics(%d, %v, %d) error %v, want ok %v", tt.lifetime, tt.respawn, tt.maxIPs, err, tt.ok)
+		}
+	}
+}
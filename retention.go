@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Snapshotter writes the periodic and triggered snapshots of a run and, if
+// configured, prunes old periodic ones. Snapshots are numbered in the order
+// they are taken: periodic snapshots are named <base>_<n>.gob and triggered
+// ones <base>_<n>_<reason>.gob. Only the periodic snapshots written by this
+// run are pruned, keeping the most recent ones, then one per hour, then one
+// per day. Files from earlier runs are never removed.
+type Snapshotter struct {
+	appState *AppState
+	base     string
+	pattern  *regexp.Regexp
+	next     int
+	requests chan string
+	written  []snapshotFile // Periodic snapshots of this run still on disk, oldest first
+
+	// OnSave, if set, is called after every snapshot that was written.
+	OnSave func(filename, reason string)
+
+	// Recent entropy reports, for the entropy drop trigger.
+	entropies []float64
+}
+
+// snapshotFile is a snapshot found on disk.
+type snapshotFile struct {
+	path    string
+	seq     int
+	modTime time.Time
+}
+
+// Snapshot triggers.
+const (
+	SnapshotPeriodic = "periodic"
+	SnapshotManual   = "manual"
+	SnapshotEntropy  = "entropy"
+)
+
+// NewSnapshotter creates a snapshotter for files named after base. Numbering
+// continues after the snapshots of earlier runs with the same base.
+func NewSnapshotter(appState *AppState, base string) (*Snapshotter, error) {
+	sn := &Snapshotter{
+		appState: appState,
+		base:     base,
+		pattern:  regexp.MustCompile(`^` + regexp.QuoteMeta(filepath.Base(base)) + `_(\d+)(_[a-z]+)?\.gob$`),
+		requests: make(chan string, 1),
+	}
+	files, err := sn.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.seq >= sn.next {
+			sn.next = f.seq + 1
+		}
+	}
+	if sn.next == 0 {
+		sn.next = 1
+	}
+	return sn, nil
+}
+
+// Request asks for a snapshot outside the schedule. Requests made while one
+// is pending are dropped.
+func (sn *Snapshotter) Request(reason string) {
+	select {
+	case sn.requests <- reason:
+	default:
+		log.Printf("Snapshot already pending, dropping %s request.", reason)
+	}
+}
+
+// ObserveStats triggers a snapshot when the entropy falls by the configured
+// amount below its peak over the configured window of reports. The window
+// starts over after a trigger, so a single drop yields a single snapshot.
+func (sn *Snapshotter) ObserveStats(stats GenerationStats) {
+	cfg := sn.appState.config
+	if cfg.SnapshotEntropyDrop <= 0 {
+		return
+	}
+	sn.entropies = append(sn.entropies, stats.Entropy)
+	if len(sn.entropies) > cfg.SnapshotEntropyWindow {
+		sn.entropies = sn.entropies[len(sn.entropies)-cfg.SnapshotEntropyWindow:]
+	}
+	peak := sn.entropies[0]
+	for _, e := range sn.entropies {
+		if e > peak {
+			peak = e
+		}
+	}
+	if peak-stats.Entropy >= cfg.SnapshotEntropyDrop {
+		log.Printf("Entropy dropped from %.3f to %.3f, taking a snapshot.", peak, stats.Entropy)
+		sn.entropies = sn.entropies[:0]
+		sn.Request(SnapshotEntropy)
+	}
+}
+
+// Run takes periodic snapshots at the configured interval, and triggered ones
+// as they are requested, until the process exits.
+func (sn *Snapshotter) Run() {
+	var tick <-chan time.Time
+	if interval := sn.appState.config.SnapshotInterval; interval > 0 {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+			sn.save(SnapshotPeriodic)
+		case reason := <-sn.requests:
+			sn.save(reason)
+		}
+	}
+}
+
+// save writes the next snapshot and prunes after periodic ones.
+func (sn *Snapshotter) save(reason string) {
+	filename := fmt.Sprintf("%s_%d.gob", sn.base, sn.next)
+	if reason != SnapshotPeriodic {
+		filename = fmt.Sprintf("%s_%d_%s.gob", sn.base, sn.next, reason)
+	}
+	sn.next++
+	if err := sn.appState.saveSnapshot(filename); err != nil {
+		fmt.Printf(" (Error saving snapshot: %v)\n", err)
+		return
+	}
+	fmt.Printf(" (Snapshot saved to %s, %s)\n", filename, reason)
+	if sn.OnSave != nil {
+		sn.OnSave(filename, reason)
+	}
+	if reason == SnapshotPeriodic {
+		sn.written = append(sn.written, snapshotFile{path: filename, seq: sn.next - 1, modTime: time.Now()})
+		if err := sn.prune(); err != nil {
+			log.Printf("Error pruning snapshots: %v", err)
+		}
+	}
+}
+
+// list returns the periodic and triggered snapshots of this base on disk,
+// oldest first, including those of earlier runs. It is only used for
+// numbering.
+func (sn *Snapshotter) list() ([]snapshotFile, error) {
+	dir := filepath.Dir(sn.base)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	var files []snapshotFile
+	for _, e := range entries {
+		m := sn.pattern.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue // Removed meanwhile
+		}
+		seq, _ := strconv.Atoi(m[1])
+		files = append(files, snapshotFile{path: filepath.Join(dir, e.Name()), seq: seq, modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].seq < files[j].seq })
+	return files, nil
+}
+
+// prune removes the periodic snapshots of this run the retention policy does
+// not keep.
+func (sn *Snapshotter) prune() error {
+	cfg := sn.appState.config
+	if cfg.SnapshotKeep == 0 {
+		return nil
+	}
+	remove := thinSnapshots(sn.written, time.Now(), cfg.SnapshotKeep, cfg.SnapshotKeepHourly, cfg.SnapshotKeepDaily)
+	removed := make(map[string]bool, len(remove))
+	var err error
+	for _, f := range remove {
+		if rmErr := os.Remove(f.path); rmErr != nil && !os.IsNotExist(rmErr) {
+			err = fmt.Errorf("failed to remove snapshot: %w", rmErr)
+			continue
+		}
+		removed[f.path] = true
+	}
+	kept := sn.written[:0]
+	for _, f := range sn.written {
+		if !removed[f.path] {
+			kept = append(kept, f)
+		}
+	}
+	sn.written = kept
+	return err
+}
+
+// thinSnapshots returns the snapshots to remove from files, which are sorted
+// oldest first. The newest keep snapshots stay. Of the older ones, the oldest
+// snapshot of each hour stays for the last hourly hours, and the oldest of
+// each day for the last daily days.
+func thinSnapshots(files []snapshotFile, now time.Time, keep, hourly, daily int) []snapshotFile {
+	if len(files) <= keep {
+		return nil
+	}
+	older := files[:len(files)-keep]
+	hourlyFrom := now.Add(-time.Duration(hourly) * time.Hour)
+	dailyFrom := now.Add(-time.Duration(daily) * 24 * time.Hour)
+	keptHours := make(map[time.Time]bool)
+	keptDays := make(map[time.Time]bool)
+	var remove []snapshotFile
+	for _, f := range older {
+		var kept map[time.Time]bool
+		var bucket time.Time
+		switch {
+		case hourly > 0 && f.modTime.After(hourlyFrom):
+			kept, bucket = keptHours, f.modTime.Truncate(time.Hour)
+		case daily > 0 && f.modTime.After(dailyFrom):
+			kept, bucket = keptDays, f.modTime.Truncate(24*time.Hour)
+		default:
+			remove = append(remove, f)
+			continue
+		}
+		if kept[bucket] {
+			remove = append(remove, f)
+			continue
+		}
+		kept[bucket] = true
+	}
+	return remove
+}
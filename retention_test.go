@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestThinSnapshots(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 3, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name                string
+		times               []time.Time // Oldest first
+		keep, hourly, daily int
+		removed             []int // Indices into times
+	}{
+		{
+			name:    "fewer than keep",
+			times:   []time.Time{at(10, 9, 0), at(10, 10, 0)},
+			keep:    3,
+			removed: nil,
+		},
+		{
+			name:    "keep newest only",
+			times:   []time.Time{at(10, 7, 0), at(10, 8, 0), at(10, 9, 0), at(10, 10, 0), at(10, 11, 0)},
+			keep:    2,
+			removed: []int{0, 1, 2},
+		},
+		{
+			name: "hourly buckets",
+			times: []time.Time{
+				at(10, 7, 10), at(10, 8, 10), at(10, 8, 40), // Before the hourly window
+				at(10, 9, 5), at(10, 9, 30), // Hour 9, the oldest stays
+				at(10, 10, 15), at(10, 10, 45), // Hour 10
+				at(10, 11, 50), // Newest
+			},
+			keep:    1,
+			hourly:  3,
+			removed: []int{0, 1, 2, 4, 6},
+		},
+		{
+			name: "daily buckets after hourly ones",
+			times: []time.Time{
+				at(6, 23, 0),               // Before the daily window
+				at(7, 13, 0), at(7, 20, 0), // Day 7, the oldest stays
+				at(8, 1, 0),               // Day 8
+				at(9, 5, 0), at(9, 18, 0), // Day 9
+				at(10, 10, 30), at(10, 10, 50), // Hour 10
+				at(10, 11, 59), // Newest
+			},
+			keep:    1,
+			hourly:  2,
+			daily:   3,
+			removed: []int{0, 2, 5, 7},
+		},
+		{
+			name:    "nothing kept beyond the newest",
+			times:   []time.Time{at(10, 9, 0), at(10, 10, 0), at(10, 11, 0)},
+			keep:    1,
+			removed: []int{0, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := make([]snapshotFile, len(tt.times))
+			for i, mt := range tt.times {
+				files[i] = snapshotFile{path: tt.times[i].Format(time.RFC3339), seq: i + 1, modTime: mt}
+			}
+			var got []int
+			for _, f := range thinSnapshots(files, now, tt.keep, tt.hourly, tt.daily) {
+				got = append(got, f.seq-1)
+			}
+			if !reflect.DeepEqual(got, tt.removed) {
+				t.Errorf("removed %v, want %v", got, tt.removed)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"evolution/vm"
+)
+
+// Scheduling policies. The goroutine policy is the original one goroutine per
+// IP; the others run a fixed pool of workers that each own a share of the IPs,
+// or, for the sharded policy, a share of the soup (see shard.go).
+const (
+	PolicyGoroutine  = "goroutine"  // One goroutine per IP, interleaved by the Go scheduler
+	PolicyRandom     = "random"     // Each worker steps uniformly random IPs from its share
+	PolicyRoundRobin = "roundrobin" // Each worker steps its share in order
+	PolicyWeighted   = "weighted"   // Each worker picks IPs with probability proportional to their weight
+	PolicySharded    = "sharded"    // Each worker owns shards of the soup and steps the IPs inside them
+)
+
+// SchedulePolicies lists the valid values of -schedule.
+var SchedulePolicies = []string{PolicyGoroutine, PolicyRandom, PolicyRoundRobin, PolicyWeighted, PolicySharded}
+
+const (
+	// workerBatchSize is how many steps a worker takes between checks of the
+	// stop channel.
+	workerBatchSize = 256
+
+	// MaxIPWeight bounds the weights drawn for IPs under the weighted policy.
+	MaxIPWeight = 8
+)
+
+// SetSchedule selects the scheduling policy and the number of workers. A
+// worker count of 0 or less leaves the current count unchanged.
+func (s *AppState) SetSchedule(policy string, workers int) error {
+	if err := checkSchedule(policy); err != nil {
+		return err
+	}
+	s.SchedulePolicy = policy
+	if workers > 0 {
+		s.Workers = workers
+	}
+	return nil
+}
+
+// SetMemoryModel selects the consistency model of soup accesses. The sharded
+// policy defines its own memory model and only runs with the racy one.
+func (s *AppState) SetMemoryModel(name string) error {
+	if err := checkMemoryModel(name, s.SchedulePolicy); err != nil {
+		return err
+	}
+	s.MemoryModel = name
+	return nil
+}
+
+// checkSchedule reports whether policy is a known scheduling policy.
+func checkSchedule(policy string) error {
+	for _, p := range SchedulePolicies {
+		if p == policy {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown scheduling policy %q (available: %v)", policy, SchedulePolicies)
+}
+
+// checkMemoryModel reports whether the memory model is known and can run
+// under the scheduling policy.
+func checkMemoryModel(name, policy string) error {
+	valid := false
+	for _, m := range vm.MemoryModels {
+		if m == name {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return fmt.Errorf("unknown memory model %q (available: %v)", name, vm.MemoryModels)
+	}
+	if name != vm.MemoryRacy && policy == PolicySharded {
+		return fmt.Errorf("memory model %q cannot be combined with the sharded policy", name)
+	}
+	return nil
+}
+
+// attachMemory creates the memory model over the current soup and gives each
+// IP its Memory. The sharded policy attaches its own.
+func (s *AppState) attachMemory() error {
+	model, err := vm.NewMemoryModel(s.MemoryModel, s.soup)
+	if err != nil {
+		return err
+	}
+	s.memory = model
+	if s.SchedulePolicy == PolicySharded {
+		return nil
+	}
+	s.population.Range(func(key, value interface{}) bool {
+		value.(*vm.IP).Memory = model.ForIP()
+		return true
+	})
+	return nil
+}
+
+// detachMemory returns every IP to direct soup access.
+func (s *AppState) detachMemory() {
+	s.population.Range(func(key, value interface{}) bool {
+		value.(*vm.IP).Memory = nil
+		return true
+	})
+}
+
+// launchWorkers splits the population across the workers and starts them.
+func (s *AppState) launchWorkers() {
+	ips := s.sortedIPs()
+	workers := s.Workers
+	if workers > len(ips) {
+		workers = len(ips)
+	}
+	shares := make([][]*vm.IP, workers)
+	for i, ip := range ips {
+		shares[i%workers] = append(shares[i%workers], ip)
+	}
+	for _, share := range shares {
+		s.ipWg.Add(1)
+		go s.runWorker(share, rand.New(rand.NewSource(rand.Int63())))
+	}
+}
+
+// runWorker steps its share of the IPs in batches according to the
+// scheduling policy until the IPs are stopped. IPs born from the share join
+// it, and the worker ends once every IP of its share has died. Unlike the
+// stop channel, a debugger halt is checked after every step.
+func (s *AppState) runWorker(ips []*vm.IP, rng *rand.Rand) {
+	defer s.ipWg.Done()
+	counts := s.startCounting()
+	defer s.stopCounting(counts)
+	for _, ip := range ips {
+		ip.Counts = counts
+	}
+
+	dynamic := s.dynamic()
+	changed := true // The share changed and the weights need rebuilding
+	var cumulative []int64
+
+	// settle applies the population dynamics to ips[i] after it stepped. A
+	// dead IP is replaced by the last one of the share, so settle reports
+	// whether ips[i] is still the IP that stepped.
+	settle := func(i int) bool {
+		born, alive := s.afterStep(ips[i])
+		if born != nil {
+			born.Memory = s.memory.ForIP()
+			born.Counts = counts
+			ips = append(ips, born)
+			changed = true
+		}
+		if !alive {
+			last := len(ips) - 1
+			ips[i] = ips[last]
+			ips[last] = nil
+			ips = ips[:last]
+			changed = true
+		}
+		return alive
+	}
+
+	next := 0
+	for {
+		select {
+		case <-s.ipStopChan:
+			return
+		default:
+		}
+		if len(ips) == 0 {
+			return
+		}
+		switch s.SchedulePolicy {
+		case PolicyRoundRobin:
+			for i := 0; i < workerBatchSize && len(ips) > 0; i++ {
+				if next >= len(ips) {
+					next = 0
+				}
+				halt := ips[next].Step()
+				if !dynamic || settle(next) {
+					next++
+				}
+				if halt || s.debugger.Halting() {
+					return
+				}
+			}
+		case PolicyWeighted:
+			if changed {
+				// Cumulative weights for the weighted policy.
+				cumulative = cumulative[:0]
+				var total int64
+				for _, ip := range ips {
+					total += int64(ip.Weight)
+					cumulative = append(cumulative, total)
+				}
+				changed = false
+			}
+			total := cumulative[len(cumulative)-1]
+			for i := 0; i < workerBatchSize && !changed; i++ {
+				r := rng.Int63n(total)
+				j := sort.Search(len(cumulative), func(k int) bool { return cumulative[k] > r })
+				halt := ips[j].Step()
+				if dynamic {
+					settle(j)
+				}
+				if halt || s.debugger.Halting() {
+					return
+				}
+			}
+		default: // PolicyRandom
+			for i := 0; i < workerBatchSize && len(ips) > 0; i++ {
+				j := rng.Intn(len(ips))
+				halt := ips[j].Step()
+				if dynamic {
+					settle(j)
+				}
+				if halt || s.debugger.Halting() {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"evolution/vm"
+)
+
+// runUntil runs the simulation until done reports true, or for at most a
+// few seconds, and pauses it.
+func runUntil(t *testing.T, s *AppState, done func() bool) {
+	t.Helper()
+	s.LaunchIPs()
+	defer s.Pause()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out running the simulation")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulePolicies(t *testing.T) {
+	for _, policy := range SchedulePolicies {
+		t.Run(policy, func(t *testing.T) {
+			s := newTestAppState(t, 1, func(s *AppState) {
+				if err := s.SetSchedule(policy, 3); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.SetPopulationDynamics(20, true, 0); err != nil {
+					t.Fatal(err)
+				}
+				// The racy model races by design.
+				if policy != PolicySharded {
+					if err := s.SetMemoryModel(vm.MemoryAtomic); err != nil {
+						t.Fatal(err)
+					}
+				}
+			})
+			runUntil(t, s, func() bool { return atomic.LoadInt64(&s.deaths) >= 32 })
+
+			// Every death respawned, and the count matches the population.
+			n := 0
+			s.population.Range(func(key, value interface{}) bool {
+				if value.(*vm.IP).Memory != nil {
+					t.Errorf("paused IP %d still has a memory attached", key)
+				}
+				n++
+				return true
+			})
+			if count := atomic.LoadInt32(&s.ipCount); n != 16 || count != 16 {
+				t.Errorf("population of %d with a count of %d, want 16", n, count)
+			}
+		})
+	}
+}
+
+func TestRoundRobinIsFair(t *testing.T) {
+	s := newTestAppState(t, 1, func(s *AppState) {
+		if err := s.SetSchedule(PolicyRoundRobin, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SetMemoryModel(vm.MemoryAtomic); err != nil {
+			t.Fatal(err)
+		}
+	})
+	s.LaunchIPs()
+	time.Sleep(20 * time.Millisecond)
+	s.Pause()
+	ips := s.sortedIPs()
+	for _, ip := range ips {
+		if d := ip.Steps - ips[0].Steps; d < -1 || d > 1 {
+			t.Fatalf("IP %d took %d steps and IP %d %d, want them within one", ip.ID, ip.Steps, ips[0].ID, ips[0].Steps)
+		}
+	}
+}
+
+func TestCheckMemoryModel(t *testing.T) {
+	tests := []struct {
+		model, policy string
+		ok            bool
+	}{
+		{vm.MemoryRacy, PolicySharded, true},
+		{vm.MemoryTransactional, PolicyRandom, true},
+		{vm.MemoryAtomic, PolicySharded, false},
+		{"strict", PolicyRandom, false},
+	}
+	for _, tt := range tests {
+		if err := checkMemoryModel(tt.model, tt.policy); (err == nil) != tt.ok {
+			t.Errorf("checkMemoryModel(%q, %q) error %v, want ok %v", tt.model, tt.policy, err, tt.ok)
+		}
+	}
+	if err := checkSchedule("fifo"); err == nil {
+		t.Error("checkSchedule accepted an unknown policy")
+	}
+}
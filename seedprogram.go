@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"evolution/vm"
+)
+
+// seedProgram is an assembler file to place in a new soup.
+type seedProgram struct {
+	Path string
+	X, Y int32
+}
+
+// seedProgramFlags collects repeated -seed-program file.asm@x,y flags.
+type seedProgramFlags []seedProgram
+
+func (f *seedProgramFlags) String() string {
+	var parts []string
+	for _, p := range *f {
+		parts = append(parts, fmt.Sprintf("%s@%d,%d", p.Path, p.X, p.Y))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (f *seedProgramFlags) Set(value string) error {
+	at := strings.LastIndex(value, "@")
+	if at < 0 {
+		return fmt.Errorf("%q: want file.asm@x,y", value)
+	}
+	coords := strings.Split(value[at+1:], ",")
+	if len(coords) != 2 {
+		return fmt.Errorf("%q: want file.asm@x,y", value)
+	}
+	x, err := strconv.ParseInt(strings.TrimSpace(coords[0]), 10, 32)
+	if err != nil {
+		return fmt.Errorf("%q: invalid x: %w", value, err)
+	}
+	y, err := strconv.ParseInt(strings.TrimSpace(coords[1]), 10, 32)
+	if err != nil {
+		return fmt.Errorf("%q: invalid y: %w", value, err)
+	}
+	*f = append(*f, seedProgram{Path: value[:at], X: int32(x), Y: int32(y)})
+	return nil
+}
+
+// placeSeedPrograms assembles each program with the active instruction set
+// and writes it into the soup.
+func (s *AppState) placeSeedPrograms(programs []seedProgram) error {
+	for _, p := range programs {
+		src, err := os.ReadFile(p.Path)
+		if err != nil {
+			return fmt.Errorf("failed to read seed program: %w", err)
+		}
+		rows, err := vm.Assemble(s.isa, string(src))
+		if err != nil {
+			return fmt.Errorf("failed to assemble %s: %w", p.Path, err)
+		}
+		s.PlaceProgram(rows, p.X, p.Y)
+		fmt.Printf("Placed seed program %s (%d rows) at (%d, %d)\n", p.Path, len(rows), p.X, p.Y)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"evolution/vm"
+)
+
+// Sharded execution splits the soup into a grid of rectangular shards, each
+// owned by one worker, and runs in epochs separated by barriers. Its memory
+// model is:
+//
+//   - Within an epoch, the IPs of a shard run one after another on the shard's
+//     worker, so accesses to cells inside the shard are sequentially
+//     consistent.
+//   - Reads of cells outside the shard return the value the cell had at the
+//     start of the epoch.
+//   - Writes to cells outside the shard are buffered and applied at the
+//     barrier, shard by shard in row-major order and in program order within
+//     a shard. A cell therefore only changes during an epoch through the IPs
+//     of its own shard.
+//   - An IP that jumps or moves out of its shard stops for the rest of the
+//     epoch and is handed off to the shard it landed in at the barrier.
+//   - Cosmic rays are applied at the barrier, as a per-step probability.
+//   - An IP that spawns or reaches its lifetime also stops for the rest of the
+//     epoch. Births and deaths are settled at the barrier in shard order, so
+//     new IPs get the same IDs whatever the number of workers.
+//
+// Every step depends only on the state at the start of the epoch and on the
+// fixed order inside each shard, so for a given number of shards the soup
+// after a given number of epochs does not depend on the number of workers.
+// The default number of shards grows with the workers, so runs that are
+// meant to compare must fix it with -shards.
+
+// shardEpochPasses is how many times each IP of a shard steps per epoch. The
+// barrier copies the whole soup, so epochs must be long enough to amortize it.
+const shardEpochPasses = 8
+
+// pendingWrite is a write to a cell outside the writer's shard.
+type pendingWrite struct {
+	addr int32
+	val  int8
+}
+
+// shard is one rectangle of the soup, with the IPs currently inside it.
+type shard struct {
+	index    int
+	ips      []*vm.IP
+	leaving  []*vm.IP // IPs that left the shard or await the population dynamics
+	memory   *shardMemory
+	counts   *vm.OpCounts // Instructions executed, see opCounters
+	executed int64        // Steps executed during the epoch
+}
+
+// shardMemory implements vm.Memory for the IPs of one shard.
+type shardMemory struct {
+	layout   *shardLayout
+	index    int
+	soup     []int8
+	snapshot []int8 // The soup as of the start of the epoch
+	writes   []pendingWrite
+}
+
+func (m *shardMemory) Begin()       {}
+func (m *shardMemory) Commit() bool { return true }
+
+func (m *shardMemory) Load(addr int32) int8 {
+	if m.layout.shardOf(addr) == m.index {
+		return m.soup[addr]
+	}
+	return m.snapshot[addr]
+}
+
+func (m *shardMemory) Store(addr int32, val int8) {
+	if m.layout.shardOf(addr) == m.index {
+		m.soup[addr] = val
+		return
+	}
+	m.writes = append(m.writes, pendingWrite{addr: addr, val: val})
+}
+
+// shardLayout maps soup cells to shards.
+type shardLayout struct {
+	dim      int // Shards per side
+	soupDimX int32
+	colShard []int // Shard column of every soup column
+	rowShard []int // Shard row of every soup row
+}
+
+func newShardLayout(dim int, soupDimX, soupDimY int32) *shardLayout {
+	l := &shardLayout{
+		dim:      dim,
+		soupDimX: soupDimX,
+		colShard: make([]int, soupDimX),
+		rowShard: make([]int, soupDimY),
+	}
+	for x := range l.colShard {
+		l.colShard[x] = x * dim / int(soupDimX)
+	}
+	for y := range l.rowShard {
+		l.rowShard[y] = y * dim / int(soupDimY)
+	}
+	return l
+}
+
+func (l *shardLayout) shardOf(addr int32) int {
+	return l.rowShard[addr/l.soupDimX]*l.dim + l.colShard[addr%l.soupDimX]
+}
+
+func (l *shardLayout) shardAt(x, y int32) int {
+	return l.rowShard[y]*l.dim + l.colShard[x]
+}
+
+// shardDim returns the number of shards per side: the configured value, or
+// enough shards to keep every worker busy.
+func (s *AppState) shardDim() int {
+	dim := s.Shards
+	if dim <= 0 {
+		dim = s.config.SoupGridDim
+		if min := int(math.Ceil(math.Sqrt(float64(s.Workers)))); dim < min {
+			dim = min
+		}
+	}
+	if dim > int(s.soupDimX) {
+		dim = int(s.soupDimX)
+	}
+	if dim > int(s.soupDimY) {
+		dim = int(s.soupDimY)
+	}
+	return dim
+}
+
+// runSharded runs the population in epochs until the IPs are stopped. It also
+// applies cosmic rays, so no separate simulator runs in this mode.
+func (s *AppState) runSharded() {
+	defer s.ipWg.Done()
+
+	layout := newShardLayout(s.shardDim(), s.soupDimX, s.soupDimY)
+	snapshot := make([]int8, len(s.soup))
+	shards := make([]*shard, layout.dim*layout.dim)
+	for i := range shards {
+		shards[i] = &shard{
+			index:  i,
+			memory: &shardMemory{layout: layout, index: i, soup: s.soup, snapshot: snapshot},
+			counts: s.startCounting(),
+		}
+		defer s.stopCounting(shards[i].counts)
+	}
+	for _, ip := range s.sortedIPs() {
+		sh := shards[layout.shardAt(ip.X, ip.Y)]
+		ip.Memory = sh.memory
+		sh.ips = append(sh.ips, ip)
+	}
+	defer func() {
+		// Paused IPs access the soup directly again.
+		for _, sh := range shards {
+			for _, ip := range sh.ips {
+				ip.Memory = nil
+			}
+			for _, ip := range sh.leaving {
+				ip.Memory = nil
+			}
+		}
+	}()
+
+	workers := s.Workers
+	if workers > len(shards) {
+		workers = len(shards)
+	}
+	for {
+		select {
+		case <-s.ipStopChan:
+			return
+		default:
+		}
+
+		copy(snapshot, s.soup)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := w; i < len(shards); i += workers {
+					shards[i].runEpoch(layout, s.IPLifetime, s.debugger)
+				}
+			}(w)
+		}
+		wg.Wait()
+		s.shardBarrier(layout, shards)
+		if s.debugger.Halting() {
+			return
+		}
+	}
+}
+
+// runEpoch steps the IPs of the shard, setting aside those that leave it. A
+// debugger halt ends the epoch early, the barrier still applying the steps
+// taken so far.
+func (sh *shard) runEpoch(layout *shardLayout, lifetime int64, debugger *Debugger) {
+	sh.executed = 0
+	for _, ip := range sh.ips {
+		ip.Counts = sh.counts
+	}
+	for pass := 0; pass < shardEpochPasses && len(sh.ips) > 0; pass++ {
+		kept := sh.ips[:0]
+		for i, ip := range sh.ips {
+			halt := ip.Step()
+			sh.executed++
+			settling := ip.Spawn || (lifetime > 0 && ip.Steps >= lifetime)
+			if !settling && layout.shardAt(ip.X, ip.Y) == sh.index {
+				kept = append(kept, ip)
+			} else {
+				sh.leaving = append(sh.leaving, ip)
+			}
+			if halt || debugger.Halting() {
+				// The IPs yet to step this pass stay in the shard.
+				sh.ips = append(kept, sh.ips[i+1:]...)
+				return
+			}
+		}
+		sh.ips = kept
+	}
+}
+
+// shardBarrier applies the buffered writes, settles births and deaths, hands
+// off the IPs that changed shard and applies cosmic rays for the steps of the
+// epoch.
+func (s *AppState) shardBarrier(layout *shardLayout, shards []*shard) {
+	var executed int64
+	for _, sh := range shards {
+		for _, w := range sh.memory.writes {
+			s.soup[w.addr] = w.val
+		}
+		sh.memory.writes = sh.memory.writes[:0]
+		executed += sh.executed
+	}
+	dynamic := s.dynamic()
+	for _, sh := range shards {
+		for _, ip := range sh.leaving {
+			alive := true
+			if dynamic {
+				var born *vm.IP
+				born, alive = s.afterStep(ip)
+				if born != nil {
+					dest := shards[layout.shardAt(born.X, born.Y)]
+					born.Memory = dest.memory
+					dest.ips = append(dest.ips, born)
+				}
+			}
+			if !alive {
+				ip.Memory = nil
+				continue
+			}
+			dest := shards[layout.shardAt(ip.X, ip.Y)]
+			ip.Memory = dest.memory
+			dest.ips = append(dest.ips, ip)
+		}
+		sh.leaving = sh.leaving[:0]
+	}
+
+	p := math.Float64frombits(atomic.LoadUint64(&s.cosmicRayRate))
+	if p > 0 {
+		for i := int64(0); i < executed; i++ {
+			if s.rng.Float64() < p {
+				index := s.rng.Intn(len(s.soup))
+				bit := uint(s.rng.Intn(8))
+				s.soup[index] ^= (1 << bit)
+			}
+		}
+	}
+}
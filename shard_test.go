@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestShardBarrierAppliesWritesInOrder(t *testing.T) {
+	s := newTestAppState(t, 1, nil)
+	s.SetCosmicRayRate(0)
+	layout := newShardLayout(2, s.soupDimX, s.soupDimY)
+	snapshot := append([]int8(nil), s.soup...)
+	shards := make([]*shard, 4)
+	for i := range shards {
+		shards[i] = &shard{
+			index:  i,
+			memory: &shardMemory{layout: layout, index: i, soup: s.soup, snapshot: snapshot},
+		}
+	}
+	// Cells in the top left and bottom right shards.
+	topLeft := int32(0)
+	bottomRight := (s.soupDimY-1)*s.soupDimX + s.soupDimX - 1
+	s.soup[topLeft], s.soup[bottomRight] = 0, 0
+	copy(snapshot, s.soup)
+
+	// The bottom right shard writes the top left cell twice, and so does the
+	// top right shard, which comes first at the barrier.
+	shards[3].memory.Store(topLeft, 1)
+	shards[3].memory.Store(topLeft, 2)
+	shards[1].memory.Store(topLeft, 3)
+	shards[1].memory.Store(topLeft, 4)
+	// The owner writes its cell at once, and the others see it at the barrier.
+	shards[3].memory.Store(bottomRight, 5)
+	shards[0].memory.Store(bottomRight, 6)
+
+	if got := s.soup[topLeft]; got != 0 {
+		t.Errorf("write to another shard's cell applied before the barrier: %d", got)
+	}
+	if got := shards[3].memory.Load(bottomRight); got != 5 {
+		t.Errorf("shard reads its own cell as %d, want 5", got)
+	}
+	if got := shards[0].memory.Load(bottomRight); got != 0 {
+		t.Errorf("shard reads another shard's cell as %d, want the epoch's start value 0", got)
+	}
+
+	s.shardBarrier(layout, shards)
+	if got := s.soup[topLeft]; got != 2 {
+		t.Errorf("top left cell is %d after the barrier, want 2 from the last shard", got)
+	}
+	if got := s.soup[bottomRight]; got != 6 {
+		t.Errorf("bottom right cell is %d after the barrier, want the buffered 6", got)
+	}
+	for _, sh := range shards {
+		if len(sh.memory.writes) != 0 {
+			t.Errorf("shard %d still buffers %d writes", sh.index, len(sh.memory.writes))
+		}
+	}
+}
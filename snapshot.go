@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"evolution/vm"
+)
+
+// SnapshotVersion is the version of the snapshot format written by
+// saveSnapshot. Snapshots from before versioning decode as version 0.
+//
+//	0: Soup, IPs, seed and, depending on their age, some of the run settings.
+//	   NextIPID was never written.
+//	1: Adds the version, the save time, the full run config including
+//	   scheduling and population dynamics, NextIPID, the elapsed time and the
+//	   statistics history.
+//	2: Adds the motif lineage.
+const SnapshotVersion = 2
+
+// MaxStatsHistory bounds the statistics history kept in memory and in
+// snapshots. At one report per second it covers a day. Only the latest report
+// keeps its per-block entropies and instruction mixes, see recordStats.
+const MaxStatsHistory = 24 * 60 * 60
+
+// loadSnapshot loads a simulation state from a snapshot file.
+func (s *AppState) loadSnapshot(filename string) error {
+	state, err := readSnapshot(filename)
+	if err != nil {
+		return err
+	}
+	return s.restoreSnapshot(state)
+}
+
+// restoreSnapshot replaces the simulation state with a decoded snapshot. The
+// IPs must not be running. The snapshot is checked in full before anything
+// is replaced, so a snapshot that cannot be restored leaves the state as it
+// was.
+func (s *AppState) restoreSnapshot(state SimulationState) error {
+	if err := s.migrateSnapshot(&state); err != nil {
+		return fmt.Errorf("failed to migrate snapshot: %w", err)
+	}
+
+	// The snapshot's parameters replace the configured ones, except for those
+	// that belong to this process rather than to the run.
+	restored := state.Config.withProcessSettings(s.config)
+	if err := restored.Validate(); err != nil {
+		return fmt.Errorf("snapshot has invalid parameters: %w", err)
+	}
+	if len(state.Soup) != restored.SoupSize() {
+		return fmt.Errorf("snapshot soup has %d cells but its parameters give %d", len(state.Soup), restored.SoupSize())
+	}
+	if err := checkSchedule(state.SchedulePolicy); err != nil {
+		return fmt.Errorf("failed to restore scheduling policy: %w", err)
+	}
+	if err := checkMemoryModel(state.MemoryModel, state.SchedulePolicy); err != nil {
+		return fmt.Errorf("failed to restore memory model: %w", err)
+	}
+	isa, err := vm.LookupISA(state.ISA)
+	if err != nil {
+		return fmt.Errorf("failed to restore instruction set: %w", err)
+	}
+	// The spawn op is resolved in the snapshot's instruction set.
+	spawnOp, err := lookupSpawnOp(isa, state.SpawnOp)
+	if err != nil {
+		return fmt.Errorf("failed to restore spawn op: %w", err)
+	}
+	if err := checkPopulationDynamics(state.IPLifetime, state.Respawn, int(state.MaxIPs)); err != nil {
+		return fmt.Errorf("failed to restore population dynamics: %w", err)
+	}
+	if err := checkLineage(state.Lineage, state.NextMotifID); err != nil {
+		return fmt.Errorf("failed to restore motif lineage: %w", err)
+	}
+
+	s.applyConfig(restored)
+	s.generation = state.Generation
+	copy(s.soup, state.Soup)
+	s.nextIPID = state.NextIPID
+	s.randSeed = state.RandSeed
+	rand.Seed(s.randSeed)
+	if state.Deterministic {
+		s.Deterministic = true
+	}
+	s.SchedulePolicy = state.SchedulePolicy
+	s.Shards = state.Shards
+	s.MemoryModel = state.MemoryModel
+	s.isa = isa
+	s.spawnOpName, s.spawnOp = state.SpawnOp, spawnOp
+	s.IPLifetime, s.Respawn, s.MaxIPs = state.IPLifetime, state.Respawn, state.MaxIPs
+	atomic.StoreInt64(&s.births, state.Births)
+	atomic.StoreInt64(&s.deaths, state.Deaths)
+	atomic.StoreInt64(&s.retiredSteps, state.RetiredSteps)
+	atomic.StoreInt64(&s.rounds, state.Rounds)
+	s.rng = vm.NewRNG(s.randSeed, 0)
+	if state.SchedulerRandState != 0 {
+		s.rng.State = state.SchedulerRandState
+	}
+	s.timeElapsed = state.TimeElapsed
+	s.startTime = time.Now()
+	s.historyMu.Lock()
+	s.history = state.History
+	s.historyMu.Unlock()
+	s.motifs.Restore(state.Lineage, state.NextMotifID)
+
+	// Clear existing population before loading new ones
+	s.population.Range(func(key, value interface{}) bool {
+		s.population.Delete(key)
+		return true
+	})
+	atomic.StoreInt32(&s.ipCount, 0)
+
+	for _, savableIP := range state.IPs {
+		ip := s.newIP(savableIP.ID, savableIP.X, savableIP.Y)
+		ip.Steps = savableIP.Steps
+		if savableIP.Weight > 0 {
+			ip.Weight = savableIP.Weight
+		}
+		if ip.Rand != nil && savableIP.RandState != 0 {
+			ip.Rand.State = savableIP.RandState
+		}
+		s.population.Store(ip.ID, ip)
+		atomic.AddInt32(&s.ipCount, 1)
+	}
+
+	return nil
+}
+
+// migrateSnapshot brings a decoded snapshot up to the current version. The
+// settings an older snapshot does not record are taken from the current
+// ones, which come from the config file and flags.
+func (s *AppState) migrateSnapshot(state *SimulationState) error {
+	if state.Version > SnapshotVersion {
+		return fmt.Errorf("snapshot version %d is newer than the supported version %d", state.Version, SnapshotVersion)
+	}
+	if state.Version == 0 {
+		if state.Config.VisDim == 0 {
+			cfg, err := legacyConfig(s.config, len(state.Soup))
+			if err != nil {
+				return err
+			}
+			state.Config = cfg
+		}
+		if state.ISA == "" {
+			state.ISA = s.isa.Name()
+		}
+		if state.MemoryModel == "" {
+			state.MemoryModel = s.MemoryModel
+		}
+		if state.SchedulePolicy == "" {
+			state.SchedulePolicy = s.SchedulePolicy
+			state.Shards = s.Shards
+			if state.SchedulePolicy == PolicySharded && state.MemoryModel != vm.MemoryRacy {
+				state.SchedulePolicy = PolicyRandom
+			}
+		}
+		state.IPLifetime = s.IPLifetime
+		state.Respawn = s.Respawn
+		state.SpawnOp = s.spawnOpName
+		state.MaxIPs = s.MaxIPs
+		// NextIPID was never written, so continue after the highest ID.
+		for _, ip := range state.IPs {
+			if int32(ip.ID) > state.NextIPID {
+				state.NextIPID = int32(ip.ID)
+			}
+		}
+	}
+	state.Version = SnapshotVersion
+	return nil
+}
+
+// legacyConfig derives the parameters of a snapshot that predates them from
+// the configured ones and the size of its soup, which was always square.
+func legacyConfig(cfg Config, soupSize int) (Config, error) {
+	dim := int(math.Sqrt(float64(soupSize)))
+	if dim*dim != soupSize || dim < 2 {
+		return cfg, fmt.Errorf("snapshot soup of %d cells is not square", soupSize)
+	}
+	if cfg.SoupGridDim*cfg.VisDim != dim {
+		if dim%cfg.VisDim == 0 {
+			cfg.SoupGridDim = dim / cfg.VisDim
+		} else {
+			cfg.SoupGridDim = 1
+			cfg.VisDim = dim
+		}
+	}
+	return cfg, nil
+}
+
+// saveSnapshot saves the current simulation state to a .gob file. The state
+// is captured at a single moment, and the IPs only stop for the capture, not
+// for the write.
+func (s *AppState) saveSnapshot(filename string) error {
+	return writeSnapshot(filename, s.captureSnapshot())
+}
+
+// captureSnapshot copies the simulation state while the IPs are quiesced.
+func (s *AppState) captureSnapshot() SimulationState {
+	var state SimulationState
+	s.quiesce(func() { state = s.snapshotState() })
+	return state
+}
+
+// snapshotState copies the simulation state. The IPs must not be running.
+func (s *AppState) snapshotState() SimulationState {
+	var savableIPs []vm.SavableIP
+	for _, ip := range s.sortedIPs() {
+		savableIPs = append(savableIPs, ip.CurrentState())
+	}
+
+	snapshotState := SimulationState{
+		Version:        SnapshotVersion,
+		SavedAt:        time.Now(),
+		Generation:     s.generation,
+		Soup:           append([]int8(nil), s.soup...),
+		IPs:            savableIPs,
+		NextIPID:       atomic.LoadInt32(&s.nextIPID),
+		RandSeed:       s.randSeed,
+		Config:         s.currentConfig(),
+		ISA:            s.isa.Name(),
+		MemoryModel:    s.MemoryModel,
+		SchedulePolicy: s.SchedulePolicy,
+		Shards:         s.Shards,
+		IPLifetime:     s.IPLifetime,
+		Respawn:        s.Respawn,
+		SpawnOp:        s.spawnOpName,
+		MaxIPs:         s.MaxIPs,
+		Births:         atomic.LoadInt64(&s.births),
+		Deaths:         atomic.LoadInt64(&s.deaths),
+		RetiredSteps:   atomic.LoadInt64(&s.retiredSteps),
+		TimeElapsed:    s.elapsed().Microseconds(),
+		History:        s.statsHistory(),
+		Deterministic:  s.Deterministic,
+		Rounds:         atomic.LoadInt64(&s.rounds),
+	}
+	snapshotState.Lineage, snapshotState.NextMotifID = s.motifs.Save()
+	if s.rng != nil {
+		snapshotState.SchedulerRandState = s.rng.State
+	}
+	return snapshotState
+}
+
+// elapsed returns the simulated wall-clock time of the run, including the
+// time before the snapshot it was loaded from.
+func (s *AppState) elapsed() time.Duration {
+	return time.Duration(s.timeElapsed)*time.Microsecond + time.Since(s.startTime)
+}
+
+// recordStats appends a statistics report to the history, dropping the
+// oldest reports beyond MaxStatsHistory. The previous report loses its
+// per-block entropies and instruction mixes, which would otherwise make a
+// full history, and every snapshot and checkpoint carrying it, many times
+// larger. The metrics files keep them for every report.
+func (s *AppState) recordStats(stats GenerationStats) {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	if n := len(s.history); n > 0 {
+		last := &s.history[n-1]
+		last.BlockEntropies, last.StaticMix, last.DynamicMix = nil, nil, nil
+	}
+	if len(s.history) >= MaxStatsHistory {
+		s.history = append(s.history[:0], s.history[len(s.history)-MaxStatsHistory+1:]...)
+	}
+	s.history = append(s.history, stats)
+}
+
+// statsHistory returns a copy of the statistics history.
+func (s *AppState) statsHistory() []GenerationStats {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	return append([]GenerationStats(nil), s.history...)
+}
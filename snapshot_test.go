@@ -0,0 +1,161 @@
+package main
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"evolution/vm"
+)
+
+// newTestAppState creates a small simulation initialized from seed. setup,
+// if set, configures the run before the soup and IPs are created.
+func newTestAppState(t *testing.T, seed int64, setup func(s *AppState)) *AppState {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.VisDim = 32
+	cfg.InitialIPs = 16
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := NewAppState(cfg)
+	if setup != nil {
+		setup(s)
+	}
+	s.initializeSimulation(seed)
+	return s
+}
+
+func TestRestoreSnapshotResolvesSpawnOpInItsISA(t *testing.T) {
+	source := newTestAppState(t, 1, func(s *AppState) {
+		if err := s.SetISA("shift"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SetSpawnOp("SHL"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	// NOT_S1 is the op the shift ISA replaces with SHL.
+	target := newTestAppState(t, 2, func(s *AppState) {
+		if err := s.SetSpawnOp("NOT_S1"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if err := target.restoreSnapshot(source.snapshotState()); err != nil {
+		t.Fatalf("restoreSnapshot: %v", err)
+	}
+	if target.isa.Name() != "shift" || target.spawnOpName != "SHL" || target.spawnOp != int16(vm.OP_SHL) {
+		t.Errorf("restored ISA %s with spawn op %q (%d), want shift with SHL (%d)",
+			target.isa.Name(), target.spawnOpName, target.spawnOp, vm.OP_SHL)
+	}
+}
+
+func TestRestoreSnapshotFailureLeavesState(t *testing.T) {
+	source := newTestAppState(t, 1, func(s *AppState) {
+		if err := s.SetISA("shift"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	state := source.snapshotState()
+	state.Config.VisDim = 16
+	state.Soup = state.Soup[:16*16]
+	state.Lineage = []LineageNode{{ID: 0, Parent: 3}} // Parent never seen
+	state.NextMotifID = 1
+
+	target := newTestAppState(t, 2, nil)
+	soup := append([]int8(nil), target.soup...)
+	config := target.config
+	ips := target.sortedIPs()
+
+	if err := target.restoreSnapshot(state); err == nil {
+		t.Fatal("restoreSnapshot accepted an inconsistent lineage")
+	}
+	if !reflect.DeepEqual(target.soup, soup) || target.config != config {
+		t.Error("failed restore changed the soup or the parameters")
+	}
+	if target.isa.Name() != vm.DefaultISAName {
+		t.Errorf("failed restore changed the ISA to %s", target.isa.Name())
+	}
+	if !reflect.DeepEqual(target.sortedIPs(), ips) {
+		t.Error("failed restore changed the population")
+	}
+}
+
+func TestCaptureSnapshotWhileRunning(t *testing.T) {
+	t.Run("deterministic", func(t *testing.T) {
+		s := newTestAppState(t, 1, func(s *AppState) { s.Deterministic = true })
+		s.LaunchIPs()
+		defer s.Pause()
+		for i := 0; i < 3; i++ {
+			time.Sleep(5 * time.Millisecond)
+			// Captured between rounds, so every IP has stepped once per round.
+			state := s.captureSnapshot()
+			for _, ip := range state.IPs {
+				if ip.Steps != state.Rounds {
+					t.Fatalf("IP %d took %d steps in %d rounds", ip.ID, ip.Steps, state.Rounds)
+				}
+			}
+		}
+	})
+
+	t.Run("workers", func(t *testing.T) {
+		s := newTestAppState(t, 1, func(s *AppState) {
+			if err := s.SetSchedule(PolicyRandom, 2); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.SetMemoryModel(vm.MemoryAtomic); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.SetPopulationDynamics(20, true, 0); err != nil {
+				t.Fatal(err)
+			}
+		})
+		s.LaunchIPs()
+		defer s.Pause()
+		var last int64
+		for i := 0; i < 3; i++ {
+			time.Sleep(5 * time.Millisecond)
+			state := s.captureSnapshot()
+			// Each respawn issued the next ID, and replaced the IP that died.
+			if len(state.IPs) != 16 || state.NextIPID != int32(16+state.Births) || state.Births != state.Deaths {
+				t.Fatalf("captured %d IPs, next IP ID %d, %d births and %d deaths", len(state.IPs), state.NextIPID, state.Births, state.Deaths)
+			}
+			if state.Births < last {
+				t.Fatalf("births went back from %d to %d", last, state.Births)
+			}
+			last = state.Births
+		}
+		// The IPs run again after a capture.
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt64(&s.births) == last {
+			if time.Now().After(deadline) {
+				t.Fatal("the IPs did not run again after the capture")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
+
+func TestRecordStatsKeepsPayloadsOfLatestOnly(t *testing.T) {
+	s := &AppState{}
+	reports := testStats()
+	s.recordStats(reports[1])
+	s.recordStats(reports[1])
+	history := s.statsHistory()
+	if len(history) != 2 {
+		t.Fatalf("history holds %d reports, want 2", len(history))
+	}
+	if old := history[0]; old.BlockEntropies != nil || old.StaticMix != nil || old.Entropy != 7.5 {
+		t.Errorf("older report kept as %+v, want its payloads stripped", old)
+	}
+	if latest := history[1]; !reflect.DeepEqual(latest, reports[1]) {
+		t.Errorf("latest report is %+v, want %+v", latest, reports[1])
+	}
+	// Copies taken earlier are not affected.
+	s.recordStats(reports[0])
+	if history[1].StaticMix == nil {
+		t.Error("recording a report changed a copy of the history")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Snapshot files consist of a header and a gzip-compressed gob of the
+// SimulationState:
+//
+//	magic    8 bytes   snapshotMagic
+//	length   8 bytes   big-endian length of the compressed data
+//	checksum 32 bytes  SHA-256 of the compressed data
+//	data     length bytes
+//
+// Files without the magic are plain gobs, as written by earlier versions.
+const snapshotMagic = "EVOSNAP1"
+
+const snapshotHeaderSize = len(snapshotMagic) + 8 + sha256.Size
+
+// writeSnapshot encodes a captured state to a snapshot file. The file is
+// written under a temporary name, synced and renamed into place, so a crash
+// leaves either the previous file or the complete new one.
+func writeSnapshot(filename string, snapshotState SimulationState) error {
+	var data bytes.Buffer
+	zw := gzip.NewWriter(&data)
+	if err := gob.NewEncoder(zw).Encode(snapshotState); err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to compress snapshot: %w", err)
+	}
+
+	header := make([]byte, snapshotHeaderSize)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint64(header[len(snapshotMagic):], uint64(data.Len()))
+	checksum := sha256.Sum256(data.Bytes())
+	copy(header[len(snapshotMagic)+8:], checksum[:])
+
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, base+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	// Clean up the temporary file unless it was renamed into place.
+	renamed := false
+	defer func() {
+		if !renamed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	// CreateTemp makes the file private, snapshots have always been readable.
+	if err := tmp.Chmod(0644); err != nil {
+		return fmt.Errorf("failed to set snapshot permissions: %w", err)
+	}
+	if _, err := tmp.Write(header); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if _, err := data.WriteTo(tmp); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return fmt.Errorf("failed to move snapshot into place: %w", err)
+	}
+	renamed = true
+
+	// Sync the directory so the rename itself survives a crash. Not every
+	// platform supports this, so failures are ignored.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// readSnapshot reads and verifies a snapshot file. Truncated and corrupted
+// files are reported as such rather than as decoding errors.
+func readSnapshot(filename string) (SimulationState, error) {
+	var state SimulationState
+	file, err := os.Open(filename)
+	if err != nil {
+		return state, fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	magic, err := r.Peek(len(snapshotMagic))
+	if err != nil || string(magic) != snapshotMagic {
+		// A plain gob from before the file format.
+		if err := gob.NewDecoder(r).Decode(&state); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+				return state, fmt.Errorf("snapshot %s is truncated: %w", filename, err)
+			}
+			return state, fmt.Errorf("failed to decode snapshot: %w", err)
+		}
+		return state, nil
+	}
+
+	header := make([]byte, snapshotHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return state, fmt.Errorf("snapshot %s is truncated: incomplete header", filename)
+	}
+	length := binary.BigEndian.Uint64(header[len(snapshotMagic):])
+	var checksum [sha256.Size]byte
+	copy(checksum[:], header[len(snapshotMagic)+8:])
+
+	info, err := file.Stat()
+	if err != nil {
+		return state, fmt.Errorf("failed to stat snapshot file: %w", err)
+	}
+	if available := uint64(info.Size()) - uint64(snapshotHeaderSize); available != length {
+		if available < length {
+			return state, fmt.Errorf("snapshot %s is truncated: expected %d bytes of data, found %d", filename, length, available)
+		}
+		return state, fmt.Errorf("snapshot %s is corrupted: expected %d bytes of data, found %d", filename, length, available)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return state, fmt.Errorf("snapshot %s is truncated: %w", filename, err)
+	}
+	if sha256.Sum256(data) != checksum {
+		return state, fmt.Errorf("snapshot %s is corrupted: checksum mismatch", filename)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return state, fmt.Errorf("failed to decompress snapshot: %w", err)
+	}
+	if err := gob.NewDecoder(zr).Decode(&state); err != nil {
+		return state, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	return state, nil
+}
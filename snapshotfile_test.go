@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"evolution/vm"
+)
+
+// testSnapshotState returns a state with every kind of field set, so a lossy
+// encoding shows up in a comparison.
+func testSnapshotState() SimulationState {
+	soup := make([]int8, 64*64)
+	for i := range soup {
+		soup[i] = int8(i * 7)
+	}
+	return SimulationState{
+		Version:    SnapshotVersion,
+		SavedAt:    time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC),
+		Generation: 3,
+		Soup:       soup,
+		IPs: []vm.SavableIP{
+			{ID: 1, X: 5, Y: 9, Steps: 1000, RandState: 42, Weight: 3},
+			{ID: 4, X: 63, Y: 0, Steps: 7, Weight: 1},
+		},
+		NextIPID:       4,
+		RandSeed:       12345,
+		Config:         DefaultConfig(),
+		ISA:            "shift",
+		SchedulePolicy: PolicyRoundRobin,
+		IPLifetime:     5000,
+		Births:         2,
+		Deaths:         1,
+		TimeElapsed:    90 * 1000 * 1000,
+		History: []GenerationStats{
+			{Generation: "00:00:01", Population: 2, StepsPerSecond: 500, Entropy: 7.5},
+		},
+		Lineage: []LineageNode{
+			{ID: 0, Cells: []int8{1, 2, 3}, Parent: -1, FirstSeen: 30, LastSeen: 60, PeakCount: 5, PeakAt: 60},
+			{ID: 1, Cells: []int8{1, 2, 4}, Parent: 0, Distance: 1, FirstSeen: 60, LastSeen: 60, PeakCount: 4, PeakAt: 60},
+		},
+		NextMotifID: 2,
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	want := testSnapshotState()
+
+	t.Run("current format", func(t *testing.T) {
+		filename := filepath.Join(dir, "snapshot.gob")
+		if err := writeSnapshot(filename, want); err != nil {
+			t.Fatalf("writeSnapshot: %v", err)
+		}
+		got, err := readSnapshot(filename)
+		if err != nil {
+			t.Fatalf("readSnapshot: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("read back %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("plain gob", func(t *testing.T) {
+		// The snapshot as written before the file format and versioning:
+		// no Version, Config or NextIPID.
+		type legacyIP struct {
+			ID                 int
+			X, Y               int32
+			Steps              int64
+			CurrentInstruction int8
+		}
+		type legacyState struct {
+			Generation int
+			Soup       []int8
+			IPs        []legacyIP
+			RandSeed   int64
+		}
+		legacy := legacyState{
+			Generation: want.Generation,
+			Soup:       want.Soup,
+			IPs:        []legacyIP{{ID: 9, X: 5, Y: 9, Steps: 1000}, {ID: 4, X: 63, Steps: 7}},
+			RandSeed:   want.RandSeed,
+		}
+		filename := filepath.Join(dir, "legacy.gob")
+		file, err := os.Create(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := gob.NewEncoder(file).Encode(legacy); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		got, err := readSnapshot(filename)
+		if err != nil {
+			t.Fatalf("readSnapshot: %v", err)
+		}
+		if got.Version != 0 || got.Generation != legacy.Generation || !reflect.DeepEqual(got.Soup, legacy.Soup) ||
+			len(got.IPs) != 2 || got.IPs[0].ID != 9 || got.IPs[1].X != 63 || got.RandSeed != legacy.RandSeed {
+			t.Fatalf("read back %+v, want the fields of %+v", got, legacy)
+		}
+
+		// The 64x64 soup is two 32x32 grid cells of the configured run.
+		s := newTestAppState(t, 1, nil)
+		if err := s.migrateSnapshot(&got); err != nil {
+			t.Fatalf("migrateSnapshot: %v", err)
+		}
+		cfg := s.config
+		cfg.SoupGridDim = 2
+		if got.Version != SnapshotVersion || got.Config != cfg {
+			t.Errorf("migrated to version %d with config %+v, want version %d with %+v", got.Version, got.Config, SnapshotVersion, cfg)
+		}
+		if got.ISA != s.isa.Name() || got.MemoryModel != s.MemoryModel || got.SchedulePolicy != s.SchedulePolicy {
+			t.Errorf("migrated to ISA %q, memory model %q and schedule %q, want the configured ones", got.ISA, got.MemoryModel, got.SchedulePolicy)
+		}
+		if got.NextIPID != 9 {
+			t.Errorf("migrated NextIPID %d, want the highest IP ID 9", got.NextIPID)
+		}
+		if err := s.restoreSnapshot(got); err != nil {
+			t.Fatalf("restoreSnapshot: %v", err)
+		}
+		if ip := s.spawnIP(0, 0); ip == nil || ip.ID != 10 {
+			t.Errorf("first IP after the migration is %+v, want ID 10", ip)
+		}
+	})
+}
+
+func TestReadSnapshotRejectsDamage(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "snapshot.gob")
+	if err := writeSnapshot(original, testSnapshotState()); err != nil {
+		t.Fatalf("writeSnapshot: %v", err)
+	}
+	data, err := os.ReadFile(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := len(data) - snapshotHeaderSize
+
+	tests := []struct {
+		name   string
+		damage func(data []byte) []byte
+		want   string // Substring of the error
+	}{
+		{"truncated payload", func(d []byte) []byte { return d[:len(d)-10] }, "is truncated"},
+		{"truncated header", func(d []byte) []byte { return d[:snapshotHeaderSize-1] }, "is truncated: incomplete header"},
+		{"header only", func(d []byte) []byte { return d[:snapshotHeaderSize] }, "is truncated"},
+		{"trailing bytes", func(d []byte) []byte { return append(d, 0) }, "is corrupted"},
+		{"flipped payload byte", func(d []byte) []byte {
+			d[snapshotHeaderSize+payload/2] ^= 0xff
+			return d
+		}, "is corrupted: checksum mismatch"},
+		{"flipped payload bytes", func(d []byte) []byte {
+			for i := snapshotHeaderSize; i < len(d); i += 97 {
+				d[i] ^= 0x10
+			}
+			return d
+		}, "is corrupted: checksum mismatch"},
+		{"flipped checksum byte", func(d []byte) []byte {
+			d[snapshotHeaderSize-1] ^= 0x01
+			return d
+		}, "is corrupted: checksum mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "_")+".gob")
+			damaged := tt.damage(append([]byte(nil), data...))
+			if err := os.WriteFile(filename, damaged, 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := readSnapshot(filename)
+			if err == nil {
+				t.Fatal("readSnapshot accepted a damaged file")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("readSnapshot error %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
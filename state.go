@@ -1,14 +1,13 @@
 package main
 
 import (
-	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math"
 	"math/rand"
-	"os"
 	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,26 +17,67 @@ import (
 
 // AppState holds the entire application's state, including simulation and UI settings.
 type AppState struct {
+	// Run parameters, see config.go, and the soup geometry derived from them.
+	config          Config
+	soupDimX        int32
+	soupDimY        int32
+	statsAndVisSize int
+
 	// Simulation state
-	soup                    []int8
-	population              sync.Map
-	nextIPID                int32
-	randSeed                int64
-	generation              int
-	entropies               []float64
-	timeElapsed             int64 // In microseconds
-	cosmicRayRate           uint64
-	startTime               time.Time
+	soup           []int8
+	population     sync.Map
+	nextIPID       int32
+	randSeed       int64
+	generation     int
+	history        []GenerationStats // Statistics reported so far, see recordStats
+	historyMu      sync.Mutex
+	statsListeners []func(GenerationStats) // Called with every report, see OnStats
+	complexity     complexityMeter
+	motifs         *MotifTracker // Lineage of the motifs found in the soup, see motifs.go
+	opCounters     opCounters    // Instructions executed, for the dynamic mix
+	timeElapsed    int64         // In microseconds, run time before the snapshot the run was loaded from
+	cosmicRayRate  uint64
+	startTime      time.Time
 
 	// Control state
-	ipCount             int32
-	paused              int32 // Atomic boolean: 0 for running, 1 for paused
-	Use32BitAddressing  bool
+	ipCount               int32
+	paused                int32 // Atomic boolean: 0 for running, 1 for paused
+	Use32BitAddressing    bool
 	UseRelativeAddressing bool
+	isa                   vm.ISA // Instruction set every IP executes
+	SchedulePolicy        string // How IPs are interleaved, see scheduler.go
+	Workers               int    // Number of workers for the pooled policies
+	Shards                int    // Shards per side for the sharded policy, 0 picks a default
+	MemoryModel           string // Consistency model of soup accesses, see vm/memory.go
+	memory                vm.MemoryModel
+	debugger              *Debugger
+
+	// Deterministic execution: a single scheduler goroutine steps the IPs in
+	// ID order, each IP draws from its own RNG stream, and cosmic rays come
+	// from the scheduler's stream, so a seed always yields the same soup.
+	Deterministic bool
+	rng           *vm.RNG       // Scheduler stream for cosmic rays in deterministic mode
+	rounds        int64         // Completed deterministic rounds (atomic)
+	roundLimit    int64         // Stop after this many rounds, 0 runs forever
+	finished      chan struct{} // Closed when roundLimit is reached
+	roundRest     []*vm.IP      // IPs yet to step in a round halted by the debugger
+
+	// Population dynamics, see population.go.
+	IPLifetime   int64  // Steps an IP lives, 0 for immortal IPs
+	Respawn      bool   // Replace each IP that dies with one at a random location
+	MaxIPs       int32  // Cap on the population for births, 0 for no cap
+	spawnOpName  string // Mnemonic of the ALU op that releases a new IP
+	spawnOp      int16  // spawnOpName decoded in the active ISA, or vm.NoSpawn
+	births       int64  // IPs born since the start (atomic)
+	deaths       int64  // IPs that died since the start (atomic)
+	retiredSteps int64  // Steps executed by IPs that died (atomic)
 
 	// Goroutine management
 	ipStopChan chan struct{}
 	ipWg       sync.WaitGroup
+	controlMu  sync.Mutex    // Serializes stopping and starting the IPs, and paused steps
+	done       chan struct{} // Closed by Stop
+	stopOnce   sync.Once
 
 	// Visualization state
 	viewStartIndex int
@@ -45,133 +85,313 @@ type AppState struct {
 	visRequestChan chan struct{} // For on-demand visualization updates
 }
 
-// NewAppState initializes a new simulation state.
-func NewAppState() *AppState {
+// NewAppState initializes a new simulation state with the given run
+// parameters, which must be valid.
+func NewAppState(cfg Config) *AppState {
 	s := &AppState{
-		soup:                  make([]int8, SoupSize),
-		viewStartIndex:        0,
-		viewEndIndex:          StatsAndVisSize,
-		Use32BitAddressing:    false,
-		UseRelativeAddressing: true,
-		ipStopChan:            make(chan struct{}),
-		visRequestChan:        make(chan struct{}, 1),
-		startTime:             time.Now(),
-	}
-	// Set a default cosmic ray rate.
-	atomic.StoreUint64(&s.cosmicRayRate, math.Float64bits(0.001))
+		ipStopChan:     make(chan struct{}),
+		visRequestChan: make(chan struct{}, 1),
+		finished:       make(chan struct{}),
+		done:           make(chan struct{}),
+		debugger:       NewDebugger(),
+		motifs:         NewMotifTracker(),
+		SchedulePolicy: PolicyRandom,
+		Workers:        runtime.GOMAXPROCS(0),
+		MemoryModel:    vm.MemoryRacy,
+		spawnOp:        vm.NoSpawn,
+		startTime:      time.Now(),
+	}
+	s.applyConfig(cfg)
+	s.isa, _ = vm.LookupISA(vm.DefaultISAName)
 	return s
 }
 
-// loadSnapshot loads a simulation state from a .gob file.
-func (s *AppState) loadSnapshot(filename string) error {
-	var state SimulationState
-	file, err := os.Open(filename)
-	if err != nil {
-		return fmt.Errorf("failed to open snapshot file: %w", err)
+// applyConfig sizes the soup for the run parameters and sets the addressing
+// modes and cosmic ray rate. A soup that changes size is reallocated empty.
+func (s *AppState) applyConfig(cfg Config) {
+	s.config = cfg
+	s.soupDimX = cfg.SoupDim()
+	s.soupDimY = cfg.SoupDim()
+	if s.statsAndVisSize != cfg.StatsAndVisSize() {
+		s.statsAndVisSize = cfg.StatsAndVisSize()
+		s.viewStartIndex = 0
+		s.viewEndIndex = s.statsAndVisSize
 	}
-	defer file.Close()
-
-	decoder := gob.NewDecoder(file)
-	if err := decoder.Decode(&state); err != nil {
-		return fmt.Errorf("failed to decode snapshot: %w", err)
+	if len(s.soup) != cfg.SoupSize() {
+		s.soup = vm.NewSoup(cfg.SoupSize())
+		s.viewStartIndex = 0
+		s.viewEndIndex = s.statsAndVisSize
 	}
-
-	s.generation = state.Generation
-	s.soup = state.Soup
-	s.nextIPID = state.NextIPID
-	s.randSeed = state.RandSeed
-	rand.Seed(s.randSeed)
-
-	// Clear existing population before loading new ones
-	s.population.Range(func(key, value interface{}) bool {
-		s.population.Delete(key)
-		return true
-	})
-	atomic.StoreInt32(&s.ipCount, 0)
-
-	for _, savableIP := range state.IPs {
-		ip := vm.NewIP(savableIP.ID, s.soup, savableIP.X, savableIP.Y, SoupDimX, s.Use32BitAddressing, s.UseRelativeAddressing)
-		s.population.Store(ip.ID, ip)
-		atomic.AddInt32(&s.ipCount, 1)
-	}
-
-	return nil
+	s.Use32BitAddressing = cfg.Use32BitAddressing
+	s.UseRelativeAddressing = cfg.UseRelativeAddressing
+	s.debugger.soupDimX = s.soupDimX
+	s.SetCosmicRayRate(cfg.CosmicRayRate)
 }
 
-// saveSnapshot saves the current simulation state to a .gob file.
-func (s *AppState) saveSnapshot(filename string) error {
-	var savableIPs []vm.SavableIP
-	s.population.Range(func(key, value interface{}) bool {
-		ip := value.(*vm.IP)
-		savableIPs = append(savableIPs, ip.CurrentState())
-		return true
-	})
-
-	snapshotState := SimulationState{
-		Generation: s.generation,
-		Soup:       s.soup,
-		IPs:        savableIPs,
-		RandSeed:   s.randSeed,
-	}
+// currentConfig returns the run parameters with the addressing modes and the
+// cosmic ray rate as they are now, since both can change during a run.
+func (s *AppState) currentConfig() Config {
+	cfg := s.config
+	cfg.Use32BitAddressing = s.Use32BitAddressing
+	cfg.UseRelativeAddressing = s.UseRelativeAddressing
+	cfg.CosmicRayRate = math.Float64frombits(atomic.LoadUint64(&s.cosmicRayRate))
+	return cfg
+}
 
-	file, err := os.Create(filename)
+// SetISA selects the instruction set by name. It must be called before the
+// population is created or loaded.
+func (s *AppState) SetISA(name string) error {
+	isa, err := vm.LookupISA(name)
 	if err != nil {
-		return fmt.Errorf("failed to create snapshot file: %w", err)
-	}
-	defer file.Close()
-
-	encoder := gob.NewEncoder(file)
-	if err := encoder.Encode(snapshotState); err != nil {
-		return fmt.Errorf("failed to encode snapshot: %w", err)
+		return err
 	}
-	return nil
+	s.isa = isa
+	return s.resolveSpawnOp()
 }
 
-// initializeSimulation sets up a new simulation with random values.
-func (s *AppState) initializeSimulation() {
-	s.randSeed = time.Now().UnixNano()
+// initializeSimulation sets up a new simulation with random values. A seed of
+// 0 picks one from the clock.
+func (s *AppState) initializeSimulation(seed int64) {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	s.randSeed = seed
 	rand.Seed(s.randSeed)
+	s.rng = vm.NewRNG(s.randSeed, 0)
 
+	// The soup and the starting positions come from a private source so they
+	// depend only on the seed.
+	initRand := rand.New(rand.NewSource(s.randSeed))
 	for i := range s.soup {
-		s.soup[i] = int8(rand.Intn(256) - 128)
+		s.soup[i] = int8(initRand.Intn(256) - 128)
 	}
 
 	atomic.StoreInt32(&s.ipCount, 0)
-	for i := 0; i < InitialNumIPs; i++ {
-		startX := rand.Int31n(SoupDimX)
-		startY := rand.Int31n(SoupDimY)
+	numIPs := s.config.NumIPs()
+	for i := 0; i < numIPs; i++ {
+		startX := initRand.Int31n(s.soupDimX)
+		startY := initRand.Int31n(s.soupDimY)
 		newID := atomic.AddInt32(&s.nextIPID, 1)
-		ip := vm.NewIP(int(newID), s.soup, startX, startY, SoupDimX, s.Use32BitAddressing, s.UseRelativeAddressing)
+		ip := s.newIP(int(newID), startX, startY)
 		s.population.Store(ip.ID, ip)
 		atomic.AddInt32(&s.ipCount, 1)
 	}
-	fmt.Printf("Simulation started with %d IPs in a soup of %d instructions. Seed: %d", InitialNumIPs, SoupSize, s.randSeed)
+	fmt.Printf("Simulation started with %d IPs in a soup of %d instructions. Seed: %d\n", numIPs, len(s.soup), s.randSeed)
+}
+
+// newIP creates an IP bound to the soup with the current addressing modes and
+// instruction set. Each IP gets its own RNG stream derived from the seed and
+// its ID, which makes deterministic runs reproducible and keeps parallel
+// workers off the shared math/rand lock.
+func (s *AppState) newIP(id int, x, y int32) *vm.IP {
+	ip := vm.NewIP(id, s.soup, x, y, s.soupDimX, s.Use32BitAddressing, s.UseRelativeAddressing)
+	ip.ISA = s.isa
+	ip.Rand = vm.NewRNG(s.randSeed, uint64(id))
+	ip.SpawnOp = s.spawnOp
+	if s.SchedulePolicy == PolicyWeighted {
+		ip.Weight = 1 + rand.Int31n(MaxIPWeight)
+	}
+	return ip
+}
+
+// sortedIPs returns the population ordered by ID, the fixed interleaving used
+// by deterministic mode.
+func (s *AppState) sortedIPs() []*vm.IP {
+	var ips []*vm.IP
+	s.population.Range(func(key, value interface{}) bool {
+		ips = append(ips, value.(*vm.IP))
+		return true
+	})
+	sort.Slice(ips, func(i, j int) bool { return ips[i].ID < ips[j].ID })
+	return ips
+}
+
+// PlaceProgram writes assembled rows into the soup with their first cell at
+// (x, y), wrapping around the soup edges.
+func (s *AppState) PlaceProgram(rows [][]int8, x, y int32) {
+	for dy, row := range rows {
+		py := ((y+int32(dy))%s.soupDimY + s.soupDimY) % s.soupDimY
+		for dx, b := range row {
+			px := ((x+int32(dx))%s.soupDimX + s.soupDimX) % s.soupDimX
+			s.soup[py*s.soupDimX+px] = b
+		}
+	}
 }
 
-// runIP is the execution loop for a single IP.
+// runIP is the execution loop for a single IP. IPs born from it get their own
+// goroutine, and the loop ends when the IP dies.
 func (s *AppState) runIP(p *vm.IP) {
 	defer s.ipWg.Done()
+	p.Counts = s.startCounting()
+	defer s.stopCounting(p.Counts)
+	dynamic := s.dynamic()
 	for {
 		select {
 		case <-s.ipStopChan:
 			return // Exit goroutine when stop signal is received
 		default:
-			p.Step()
+			// Another IP hit a debug point; this one is not stepped again.
+			if s.debugger.Halting() {
+				return
+			}
+			halt := p.Step()
+			if dynamic {
+				born, alive := s.afterStep(p)
+				if born != nil {
+					born.Memory = s.memory.ForIP()
+					s.ipWg.Add(1)
+					go s.runIP(born)
+				}
+				if !alive {
+					return
+				}
+			}
+			if halt {
+				return
+			}
 			runtime.Gosched()
 		}
 	}
 }
 
+// runDeterministic steps every IP once per round, in ID order, from a single
+// goroutine. Cosmic rays are drawn between steps from the scheduler stream.
+func (s *AppState) runDeterministic() {
+	defer s.ipWg.Done()
+	counts := s.startCounting()
+	defer s.stopCounting(counts)
+	ips, rest := s.roundIPs()
+	for {
+		select {
+		case <-s.ipStopChan:
+			return
+		default:
+			for _, ip := range ips {
+				ip.Counts = counts
+			}
+			var done, halted bool
+			ips, done, halted = s.stepRound(ips)
+			if done || halted {
+				return
+			}
+			if rest {
+				// The halted round is complete, the next one steps everyone.
+				ips, rest = s.sortedIPs(), false
+			}
+		}
+	}
+}
+
+// roundIPs returns the IPs of the next round to step, and whether they are
+// the rest of a round halted by the debugger rather than a full round. IPs of
+// the rest that left the population meanwhile, when a snapshot or a timeline
+// entry was restored, are skipped.
+func (s *AppState) roundIPs() ([]*vm.IP, bool) {
+	if s.roundRest == nil {
+		return s.sortedIPs(), false
+	}
+	var ips []*vm.IP
+	for _, ip := range s.roundRest {
+		if current, ok := s.lookupIP(ip.ID); ok && current == ip {
+			ips = append(ips, ip)
+		}
+	}
+	s.roundRest = nil
+	return ips, true
+}
 
+// stepRound executes one deterministic round and reports whether the round
+// limit has been reached. It returns the IPs for the next round: IPs that died
+// are dropped and IPs born during the round are appended, which keeps them in
+// ID order.
+//
+// A step that hits a debug point halts the round right after that step's
+// cosmic ray and population dynamics; the IPs yet to step are kept for
+// roundIPs so the round resumes where it stopped.
+func (s *AppState) stepRound(ips []*vm.IP) (next []*vm.IP, done, halted bool) {
+	p := math.Float64frombits(atomic.LoadUint64(&s.cosmicRayRate))
+	dynamic := s.dynamic()
+	var newborn []*vm.IP
+	living := ips[:0]
+	for i, ip := range ips {
+		halt := ip.Step()
+		// The rate is a per-step probability in deterministic mode.
+		if p > 0 && s.rng.Float64() < p {
+			index := s.rng.Intn(len(s.soup))
+			bit := uint(s.rng.Intn(8))
+			s.soup[index] ^= (1 << bit)
+		}
+		alive := true
+		if dynamic {
+			var born *vm.IP
+			born, alive = s.afterStep(ip)
+			if born != nil {
+				newborn = append(newborn, born)
+			}
+		}
+		if alive {
+			living = append(living, ip)
+		}
+		if halt {
+			// Non-nil even when empty: the round still has to be counted.
+			s.roundRest = append(make([]*vm.IP, 0, len(ips)-i-1), ips[i+1:]...)
+			return nil, false, true
+		}
+	}
+	for i := len(living); i < len(ips); i++ {
+		ips[i] = nil
+	}
+	ips = append(living, newborn...)
+	rounds := atomic.AddInt64(&s.rounds, 1)
+	if s.roundLimit > 0 && rounds == s.roundLimit {
+		close(s.finished)
+		return ips, true, false
+	}
+	return ips, false, false
+}
 
-// LaunchIPs starts the execution goroutines for all IPs in the population.
+// Finished is closed once a deterministic run has completed its round limit.
+func (s *AppState) Finished() <-chan struct{} {
+	return s.finished
+}
+
+// LaunchIPs starts executing the population under the scheduling policy,
+// along with the cosmic ray simulator. In deterministic mode a single
+// goroutine does both.
 func (s *AppState) LaunchIPs() {
-	s.population.Range(func(key, value interface{}) bool {
-		ip := value.(*vm.IP)
+	// IPs halted by the debugger stay stopped until the pause it asked for.
+	if s.debugger.Halting() {
+		return
+	}
+	s.refreshObservers()
+	if s.Deterministic {
+		if s.roundLimit > 0 && atomic.LoadInt64(&s.rounds) >= s.roundLimit {
+			return
+		}
 		s.ipWg.Add(1)
-		go s.runIP(ip)
-		return true
-	})
+		go s.runDeterministic()
+		return
+	}
+	if err := s.attachMemory(); err != nil {
+		log.Fatalf("Failed to set up memory model: %v", err)
+	}
+	if s.SchedulePolicy == PolicySharded {
+		s.ipWg.Add(1)
+		go s.runSharded()
+		return
+	}
+	if s.SchedulePolicy == PolicyGoroutine {
+		s.population.Range(func(key, value interface{}) bool {
+			ip := value.(*vm.IP)
+			s.ipWg.Add(1)
+			go s.runIP(ip)
+			return true
+		})
+	} else {
+		s.launchWorkers()
+	}
+	s.ipWg.Add(1)
+	go s.runCosmicRaySimulator()
 }
 
 // SetCosmicRayRate sets the rate for cosmic rays.
@@ -181,29 +401,49 @@ func (s *AppState) SetCosmicRayRate(rate float64) {
 
 // runCosmicRaySimulator picks a random index in the Soup and flips a bit.
 func (s *AppState) runCosmicRaySimulator() {
-
+	defer s.ipWg.Done()
+	mem := s.memory.ForIP()
 	for {
-		if atomic.LoadInt32(&s.paused) == 1 {
-			time.Sleep(100 * time.Millisecond) // Prevent busy-waiting
-			continue
+		select {
+		case <-s.ipStopChan:
+			return
+		default:
+		}
+		if s.debugger.Halting() {
+			return
 		}
 		currentRateBits := atomic.LoadUint64(&s.cosmicRayRate)
 		p := math.Float64frombits(currentRateBits)
 		if p > 0 && rand.Float64() < p {
-				// Pick a random index and flip a random bit.
-				index := rand.Intn(len(s.soup))
-				bit := uint(rand.Intn(8))
+			// Pick a random index and flip a random bit.
+			index := int32(rand.Intn(len(s.soup)))
+			bit := uint(rand.Intn(8))
+			if mem == nil {
 				s.soup[index] ^= (1 << bit)
+				continue
 			}
+			// Flip through the memory model like an IP write would.
+			for {
+				mem.Begin()
+				mem.Store(index, mem.Load(index)^(1<<bit))
+				if mem.Commit() {
+					break
+				}
+			}
+		}
 	}
 }
 
 // Pause sets the paused state of the simulation.
 func (s *AppState) Pause() {
 	log.Println("Pausing simulation")
+	s.controlMu.Lock()
+	defer s.controlMu.Unlock()
 	if atomic.CompareAndSwapInt32(&s.paused, 0, 1) { // If was running (0), set to paused (1)
 		close(s.ipStopChan) // Signal all runIP goroutines to stop
 		s.ipWg.Wait()       // Wait for all runIP goroutines to finish
+		s.debugger.drain()  // Forget points hit while the IPs were stopping
+		s.detachMemory()    // Paused steps access the soup directly
 
 		// Request a visualization update to show the final state.
 		select {
@@ -215,26 +455,74 @@ func (s *AppState) Pause() {
 	}
 }
 
+// Stop ends the run for good: the IPs stop as they do for Pause, and
+// RunStatistics returns. Runs that share the process, see sweep.go, are
+// stopped this way.
+func (s *AppState) Stop() {
+	s.Pause()
+	s.stopOnce.Do(func() { close(s.done) })
+}
+
 // Resume sets the paused state of the simulation to false.
 func (s *AppState) Resume() {
 	log.Println("Resuming simulation")
+	s.controlMu.Lock()
+	defer s.controlMu.Unlock()
 	if atomic.CompareAndSwapInt32(&s.paused, 1, 0) { // If was paused (1), set to running (0)
 		s.ipStopChan = make(chan struct{}) // Re-initialize the channel
-		s.LaunchIPs()                     // Restart IP goroutines
+		s.debugger.drain()                 // Forget points hit while paused
+		s.LaunchIPs()                      // Restart IP goroutines
 	} else {
 		log.Println("Simulation is already running.")
 	}
 }
 
+// quiesce runs fn while no IP is executing. A running simulation is stopped
+// at the next step boundary of every scheduler (a round in deterministic mode
+// and an epoch for the sharded policy) and restarted after fn returns, so fn
+// sees the soup and the IPs as they were at a single moment.
+func (s *AppState) quiesce(fn func()) {
+	s.controlMu.Lock()
+	defer s.controlMu.Unlock()
+	if atomic.LoadInt32(&s.paused) == 1 {
+		fn()
+		return
+	}
+	close(s.ipStopChan)
+	s.ipWg.Wait()
+	fn()
+	s.ipStopChan = make(chan struct{})
+	s.LaunchIPs()
+}
+
 // Step advances the simulation by one step if it is paused.
 func (s *AppState) Step() {
 	log.Println("Stepping simulation")
+	s.controlMu.Lock()
+	defer s.controlMu.Unlock()
 	if atomic.LoadInt32(&s.paused) == 1 {
-		s.population.Range(func(key, value interface{}) bool {
-			ip := value.(*vm.IP)
-			ip.Step()
-			return true
-		})
+		// The tables of the stopped schedulers are retired, so the step
+		// counts into a table of its own.
+		counts := s.startCounting()
+		defer s.stopCounting(counts)
+		if s.Deterministic {
+			ips, _ := s.roundIPs()
+			for _, ip := range ips {
+				ip.Counts = counts
+			}
+			s.stepRound(ips)
+		} else {
+			dynamic := s.dynamic()
+			s.population.Range(func(key, value interface{}) bool {
+				ip := value.(*vm.IP)
+				ip.Counts = counts
+				ip.Step()
+				if dynamic {
+					s.afterStep(ip)
+				}
+				return true
+			})
+		}
 		log.Println("Stepped all IPs.")
 		// Request a visualization update to show the result of the step.
 		select {
@@ -254,7 +542,7 @@ func (s *AppState) SetViewStartIndex(index int) {
 	// The client is now responsible for sending a valid, block-aligned index.
 	// The old boundary check was incorrect for a 2D-sampled view.
 	s.viewStartIndex = index
-	s.viewEndIndex = s.viewStartIndex + StatsAndVisSize // This is not strictly needed by the new vis logic
+	s.viewEndIndex = s.viewStartIndex + s.statsAndVisSize // This is not strictly needed by the new vis logic
 
 	// Request a visualization update, especially important when paused.
 	select {
@@ -266,6 +554,7 @@ func (s *AppState) SetViewStartIndex(index int) {
 // SetRelativeAddressing sets the relative addressing mode.
 func (s *AppState) SetRelativeAddressing(enabled bool) {
 	s.UseRelativeAddressing = enabled
+	s.warnAddressing()
 	s.population.Range(func(key, value interface{}) bool {
 		ip := value.(*vm.IP)
 		ip.UseRelativeAddressing = enabled
@@ -276,6 +565,7 @@ func (s *AppState) SetRelativeAddressing(enabled bool) {
 // Set32BitAddressing sets the 32-bit addressing mode.
 func (s *AppState) Set32BitAddressing(enabled bool) {
 	s.Use32BitAddressing = enabled
+	s.warnAddressing()
 	s.population.Range(func(key, value interface{}) bool {
 		ip := value.(*vm.IP)
 		ip.Use32BitAddressing = enabled
@@ -283,40 +573,58 @@ func (s *AppState) Set32BitAddressing(enabled bool) {
 	})
 }
 
-
+// warnAddressing logs when the addressing modes chosen at runtime cannot reach
+// the whole soup. They are still applied, as they always have been.
+func (s *AppState) warnAddressing() {
+	if err := s.currentConfig().Validate(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
 
 // SetIPPtr sets the X, Y of a specific IP from a 1D pointer.
 func (s *AppState) SetIPPtr(id int, ptr int32) {
-	if val, ok := s.population.Load(id); ok {
-		ip := val.(*vm.IP)
-		ip.X = ptr % SoupDimX
-		ip.Y = ptr / SoupDimX
+	if ip, ok := s.lookupIP(id); ok {
+		ip.X = ptr % s.soupDimX
+		ip.Y = ptr / s.soupDimX
 		log.Printf("Set IP %d position to (%d, %d)", id, ip.X, ip.Y)
 	} else {
 		log.Printf("IP with ID %d not found to set pointer.", id)
 	}
 }
 
+// MaxDisassemblyDim bounds the width and height of a disassembly request.
+const MaxDisassemblyDim = 64
+
+// Disassemble returns the mnemonics of the w x h region whose top-left cell is
+// (x, y), decoded with the active instruction set.
+func (s *AppState) Disassemble(x, y, w, h int32) ([][]string, error) {
+	if w <= 0 || h <= 0 || w > MaxDisassemblyDim || h > MaxDisassemblyDim {
+		return nil, fmt.Errorf("invalid disassembly region %dx%d, must be between 1x1 and %dx%d", w, h, MaxDisassemblyDim, MaxDisassemblyDim)
+	}
+	return vm.Disassemble(s.isa, s.soup, s.soupDimX, x, y, w, h), nil
+}
+
 // RunVisualization manages the real-time visualization.
 func (s *AppState) RunVisualization(hub *Hub) {
-	ticker := time.NewTicker(time.Second / TargetFPS)
+	ticker := time.NewTicker(time.Second / time.Duration(s.config.TargetFPS))
 	defer ticker.Stop()
 
-	currentIndices := make([]byte, StatsAndVisSize) // Allocate once
+	soupDimX, soupDimY := int(s.soupDimX), int(s.soupDimY)
+	currentIndices := make([]byte, s.statsAndVisSize) // Allocate once
 
 	sendFrame := func() {
 		// --- Send Soup Frame ---
 		currentViewStartIndex := s.viewStartIndex
-		viewDim := int(math.Sqrt(float64(StatsAndVisSize)))
+		viewDim := int(math.Sqrt(float64(s.statsAndVisSize)))
 		destIndex := 0
-		startX := currentViewStartIndex % SoupDimX
-		startY := currentViewStartIndex / SoupDimX
+		startX := currentViewStartIndex % soupDimX
+		startY := currentViewStartIndex / soupDimX
 
 		for y := 0; y < viewDim; y++ {
-			sourceY := (startY + y) % SoupDimY
-			sourceRowStart := sourceY * SoupDimX
+			sourceY := (startY + y) % soupDimY
+			sourceRowStart := sourceY * soupDimX
 			for x := 0; x < viewDim; x++ {
-				sourceX := (startX + x) % SoupDimX
+				sourceX := (startX + x) % soupDimX
 				sourceIndex := sourceRowStart + sourceX
 				if sourceIndex < len(s.soup) && destIndex < len(currentIndices) {
 					currentIndices[destIndex] = byte(s.soup[sourceIndex])
@@ -340,8 +648,8 @@ func (s *AppState) RunVisualization(hub *Hub) {
 		s.population.Range(func(key, value interface{}) bool {
 			ip := value.(*vm.IP)
 			// Normalize IP coordinates to be "after" the view start, handling wrap-around.
-			dx := (ip.X - viewStartX + SoupDimX) % SoupDimX
-			dy := (ip.Y - viewStartY + SoupDimY) % SoupDimY
+			dx := (ip.X - viewStartX + s.soupDimX) % s.soupDimX
+			dy := (ip.Y - viewStartY + s.soupDimY) % s.soupDimY
 
 			if dx < viewDim32 && dy < viewDim32 {
 				locations = append(locations, IPLocation{X: ip.X, Y: ip.Y})
@@ -378,60 +686,94 @@ func (s *AppState) RunVisualization(hub *Hub) {
 	}
 }
 
+// OnStats registers a function that RunStatistics calls with every report.
+// It must be called before RunStatistics starts.
+func (s *AppState) OnStats(listener func(GenerationStats)) {
+	s.statsListeners = append(s.statsListeners, listener)
+}
+
+// RunStatistics reports the statistics every second to the listeners and to
+// the frontend. The hub is nil in headless mode.
 func (s *AppState) RunStatistics(hub *Hub) {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
-	var lastTotalSteps int64
+	// Start from the current total so steps restored from a snapshot are not
+	// counted as executed in the first second.
+	lastTotalSteps := s.totalSteps()
+	lastBirths := atomic.LoadInt64(&s.births)
+	lastDeaths := atomic.LoadInt64(&s.deaths)
+	mix := mixSampler{last: time.Now()}
 	for {
 		if atomic.LoadInt32(&s.paused) == 1 {
-			time.Sleep(100 * time.Millisecond) // Prevent busy-waiting
+			select {
+			case <-s.done:
+				return
+			case <-time.After(100 * time.Millisecond): // Prevent busy-waiting
+			}
 			continue
 		}
 		select {
+		case <-s.done:
+			return
 		case <-ticker.C:
 			// --- Calculate Steps Per Second ---
-			var totalSteps int64
-			s.population.Range(func(key, value interface{}) bool {
-				ip := value.(*vm.IP)
-				totalSteps += ip.Steps
-				return true
-			})
+			totalSteps := s.totalSteps()
+			births := atomic.LoadInt64(&s.births)
+			deaths := atomic.LoadInt64(&s.deaths)
+			// The counters go back when the run is rewound, see timeline.go.
+			if totalSteps < lastTotalSteps || births < lastBirths || deaths < lastDeaths {
+				lastTotalSteps, lastBirths, lastDeaths = totalSteps, births, deaths
+			}
 			stepsPerSecond := totalSteps - lastTotalSteps
 			lastTotalSteps = totalSteps
 
-			// Soup Entropy
-			soupCounts := make(map[int32]int)
-			for _, instr := range s.soup[:StatsAndVisSize] {
-				soupCounts[int32(instr)]++
-			}
-			var soupEntropy float64
-			for _, count := range soupCounts {
-				p := float64(count) / float64(StatsAndVisSize)
-				if p > 0 {
-					soupEntropy -= p * math.Log2(p)
-				}
+			// Soup Entropy, of the whole soup and of each block
+			soupEntropy, blockEntropies := s.soupEntropies()
+			if len(blockEntropies) == 1 {
+				blockEntropies = nil // The same as the whole soup
 			}
-			s.entropies = append(s.entropies, soupEntropy)
-
-			elapsed := time.Since(s.startTime)
+			complexity := s.complexity.measure(s, time.Duration(s.config.ComplexityInterval)*time.Second)
+			staticMix, dynamicMix := mix.sample(s, time.Duration(s.config.MixInterval)*time.Second)
+			elapsed := s.elapsed()
 			hours := int(elapsed.Hours())
 			minutes := int(elapsed.Minutes()) % 60
 			seconds := int(elapsed.Seconds()) % 60
 			timeString := fmt.Sprintf("%02d:%02d:%02d", hours, minutes, seconds)
 
 			stats := GenerationStats{
-				Generation:     timeString,
-				Population:     int(atomic.LoadInt32(&s.ipCount)),
-				StepsPerSecond: stepsPerSecond,
-				Entropy:        soupEntropy,
+				Generation:         timeString,
+				Population:         int(atomic.LoadInt32(&s.ipCount)),
+				StepsPerSecond:     stepsPerSecond,
+				Entropy:            soupEntropy,
+				BlockEntropies:     blockEntropies,
+				CompressionRatio:   complexity.CompressionRatio,
+				ConditionalEntropy: complexity.ConditionalEntropy,
+				HighOrderEntropy:   complexity.HighOrderEntropy,
+				StaticMix:          staticMix,
+				DynamicMix:         dynamicMix,
+				Births:             births - lastBirths,
+				Deaths:             deaths - lastDeaths,
+			}
+			lastBirths, lastDeaths = births, deaths
+			s.recordStats(stats)
+			for _, listener := range s.statsListeners {
+				listener(stats)
 			}
+			if hub == nil {
+				continue // Headless
+			}
+			// The mixes go out in their own message.
+			stats.StaticMix, stats.DynamicMix = nil, nil
 			jsonData, err := json.Marshal(stats)
 			if err != nil {
 				log.Printf("error marshalling json: %v", err)
 			} else {
 				hub.Broadcast <- jsonData
 			}
+			if staticMix != nil {
+				broadcastInstructionMix(hub, s, stats.Generation, staticMix, dynamicMix)
+			}
 		}
 	}
 }
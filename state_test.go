@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+// newDeterministicAppState creates a small deterministic run with cosmic rays
+// and population turnover, so replays cover every source of randomness.
+func newDeterministicAppState(t *testing.T, seed int64) *AppState {
+	t.Helper()
+	return newTestAppState(t, seed, func(s *AppState) {
+		s.Deterministic = true
+		s.SetCosmicRayRate(0.01)
+		if err := s.SetPopulationDynamics(300, true, 64); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// stepRounds steps a deterministic run through n rounds.
+func stepRounds(s *AppState, n int) {
+	ips := s.sortedIPs()
+	for i := 0; i < n; i++ {
+		ips, _, _ = s.stepRound(ips)
+	}
+}
+
+// sameRun fails t unless a and b hold the same soup, IPs and next IP ID.
+func sameRun(t *testing.T, a, b *AppState) {
+	t.Helper()
+	sa, sb := a.snapshotState(), b.snapshotState()
+	if !reflect.DeepEqual(sa.Soup, sb.Soup) {
+		t.Error("soups differ")
+	}
+	if !reflect.DeepEqual(sa.IPs, sb.IPs) {
+		t.Errorf("IPs differ:\n%+v\n%+v", sa.IPs, sb.IPs)
+	}
+	if sa.NextIPID != sb.NextIPID || sa.Rounds != sb.Rounds {
+		t.Errorf("next IP ID %d after %d rounds, want %d after %d rounds", sa.NextIPID, sa.Rounds, sb.NextIPID, sb.Rounds)
+	}
+}
+
+func TestDeterministicReplay(t *testing.T) {
+	const rounds = 1000
+	a := newDeterministicAppState(t, 7)
+	b := newDeterministicAppState(t, 7)
+
+	stepRounds(a, rounds/2)
+	filename := filepath.Join(t.TempDir(), "snapshot.gob")
+	if err := writeSnapshot(filename, a.snapshotState()); err != nil {
+		t.Fatalf("writeSnapshot: %v", err)
+	}
+	stepRounds(a, rounds/2)
+	stepRounds(b, rounds)
+	if atomic.LoadInt64(&b.births) == 0 {
+		t.Fatal("no IP was born, the run does not cover population turnover")
+	}
+	sameRun(t, a, b)
+
+	// Resuming from the snapshot continues the run it was taken from.
+	state, err := readSnapshot(filename)
+	if err != nil {
+		t.Fatalf("readSnapshot: %v", err)
+	}
+	resumed := newDeterministicAppState(t, 8)
+	if err := resumed.restoreSnapshot(state); err != nil {
+		t.Fatalf("restoreSnapshot: %v", err)
+	}
+	stepRounds(resumed, rounds/2)
+	sameRun(t, resumed, b)
+}
@@ -0,0 +1,46 @@
+package main
+
+import "math"
+
+// soupEntropies returns the Shannon entropy of the cell values, in bits, over
+// the whole soup and over each block of the grid, row by row. The soup is read
+// while the IPs run, so the counts are a close estimate rather than a single
+// moment, and the simulation never waits for them.
+func (s *AppState) soupEntropies() (float64, []float64) {
+	grid := s.config.SoupGridDim
+	dim := s.config.VisDim
+	width := int(s.soupDimX)
+	counts := make([][256]int, grid*grid)
+	for y := 0; y < int(s.soupDimY); y++ {
+		row := s.soup[y*width : (y+1)*width]
+		blockRow := counts[(y/dim)*grid : (y/dim+1)*grid]
+		for bx := range blockRow {
+			c := &blockRow[bx]
+			for _, v := range row[bx*dim : (bx+1)*dim] {
+				c[uint8(v)]++
+			}
+		}
+	}
+
+	var total [256]int
+	blocks := make([]float64, len(counts))
+	for i := range counts {
+		for v, n := range counts[i] {
+			total[v] += n
+		}
+		blocks[i] = entropy(counts[i][:], dim*dim)
+	}
+	return entropy(total[:], len(s.soup)), blocks
+}
+
+// entropy returns the Shannon entropy in bits of a histogram of n values.
+func entropy(counts []int, n int) float64 {
+	var h float64
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(n)
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEntropy(t *testing.T) {
+	tests := []struct {
+		counts []int
+		want   float64
+	}{
+		{[]int{}, 0},
+		{[]int{5}, 0},
+		{[]int{3, 0, 3}, 1},
+		{[]int{1, 1, 1, 1, 0, 0, 0, 0}, 2},
+		{[]int{2, 1, 1}, 1.5},
+	}
+	for _, tt := range tests {
+		n := 0
+		for _, c := range tt.counts {
+			n += c
+		}
+		if got := entropy(tt.counts, n); math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("entropy(%v) = %g, want %g", tt.counts, got, tt.want)
+		}
+	}
+}
+
+func TestSoupEntropies(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SoupGridDim = 2
+	cfg.VisDim = 8
+	s := &AppState{config: cfg, soup: make([]int8, 16*16), soupDimX: 16, soupDimY: 16}
+	// Each block holds its own values: one, two, four and 64 of them, equally
+	// often.
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			i := (y%8)*8 + x%8
+			var v int
+			switch {
+			case y < 8 && x < 8:
+				v = 100
+			case y < 8:
+				v = i % 2
+			case x < 8:
+				v = 2 + i%4
+			default:
+				v = 6 + i
+			}
+			s.soup[y*16+x] = int8(v)
+		}
+	}
+
+	whole, blocks := s.soupEntropies()
+	// Value 100 is 1/4 of the soup, 0 and 1 are 1/8 each, 2 to 5 are 1/16
+	// each and the other 64 are 1/256 each.
+	if want := 0.5 + 0.75 + 1 + 2; math.Abs(whole-want) > 1e-12 {
+		t.Errorf("whole soup entropy %g, want %g", whole, want)
+	}
+	want := []float64{0, 1, 2, 6}
+	if len(blocks) != len(want) {
+		t.Fatalf("got %d block entropies, want %d", len(blocks), len(want))
+	}
+	for i := range want {
+		if math.Abs(blocks[i]-want[i]) > 1e-12 {
+			t.Errorf("block %d entropy %g, want %g", i, blocks[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"evolution/vm"
+)
+
+// SweepSpec describes a parameter sweep: a base config, the parameters to vary
+// and how long each run lasts. The runs are the combinations of the grid axes
+// followed by the list entries, each repeated Replicates times.
+type SweepSpec struct {
+	Config        Config       `json:"config"`        // Base parameters, over the defaults
+	Duration      string       `json:"duration"`      // Run time of each run, such as "30m"
+	Deterministic bool         `json:"deterministic"` // Run in deterministic mode
+	Rounds        int64        `json:"rounds"`        // Deterministic runs stop after this many rounds
+	ISA           string       `json:"isa"`
+	Schedule      string       `json:"schedule"`
+	Memory        string       `json:"memory"`
+	Workers       int          `json:"workers"`    // Workers per run, 0 shares GOMAXPROCS between the parallel runs
+	Replicates    int          `json:"replicates"` // Runs per parameter combination, at least 1
+	Seed          int64        `json:"seed"`       // Seed of the first run whose seed is not swept
+	Grid          SweepAxes    `json:"grid"`
+	List          []SweepPoint `json:"list"`
+}
+
+// SweepAxes are the values of each swept parameter. Every combination of the
+// non-empty axes is run.
+type SweepAxes struct {
+	Seed          []int64   `json:"seed"`
+	CosmicRayRate []float64 `json:"cosmicRayRate"`
+	Addressing    []string  `json:"addressing"`
+	IPs           []int     `json:"ips"`
+	VisDim        []int     `json:"visDim"`
+	SoupGridDim   []int     `json:"soupGridDim"`
+}
+
+// SweepPoint sets some of the swept parameters, the others come from the base
+// config.
+type SweepPoint struct {
+	Seed          *int64   `json:"seed,omitempty"`
+	CosmicRayRate *float64 `json:"cosmicRayRate,omitempty"`
+	Addressing    string   `json:"addressing,omitempty"` // relative, relative32, absolute or absolute32
+	IPs           *int     `json:"ips,omitempty"`
+	VisDim        *int     `json:"visDim,omitempty"`
+	SoupGridDim   *int     `json:"soupGridDim,omitempty"`
+}
+
+// SweepManifest records the runs of a sweep and how far each got. It is
+// rewritten whenever a run starts or ends, and read back to resume.
+type SweepManifest struct {
+	Spec SweepSpec        `json:"spec"`
+	Runs []SweepRunRecord `json:"runs"`
+}
+
+// SweepRunRecord is one run of a sweep.
+type SweepRunRecord struct {
+	ID        string           `json:"id"`
+	Dir       string           `json:"dir"` // Relative to the sweep directory
+	Point     SweepPoint       `json:"point"`
+	Replicate int              `json:"replicate"`
+	Seed      int64            `json:"seed"`
+	Config    Config           `json:"config"`
+	Status    string           `json:"status"`
+	Error     string           `json:"error,omitempty"`
+	Started   *time.Time       `json:"started,omitempty"`
+	Finished  *time.Time       `json:"finished,omitempty"`
+	Final     *GenerationStats `json:"final,omitempty"` // Last statistics report
+}
+
+// Run states in the manifest.
+const (
+	RunPending = "pending"
+	RunRunning = "running"
+	RunDone    = "done"
+	RunFailed  = "failed"
+)
+
+// Addressing modes a sweep can select.
+var sweepAddressing = map[string][2]bool{ // 32-bit, relative
+	"relative":   {false, true},
+	"relative32": {true, true},
+	"absolute":   {false, false},
+	"absolute32": {true, false},
+}
+
+// sweepMain runs the sweep subcommand.
+func sweepMain(args []string) {
+	fs := flag.NewFlagSet("sweep", flag.ExitOnError)
+	specFile := fs.String("spec", "", "JSON file describing the sweep.")
+	out := fs.String("out", "sweep", "Directory for the manifest and the run directories. An existing sweep there is resumed.")
+	parallel := fs.Int("parallel", 1, "Runs to execute at the same time.")
+	fs.Parse(args)
+	if *specFile == "" {
+		log.Fatalf("sweep requires -spec")
+	}
+	if *parallel < 1 {
+		log.Fatalf("-parallel must be at least 1, got %d", *parallel)
+	}
+
+	spec, err := LoadSweepSpec(*specFile)
+	if err != nil {
+		log.Fatalf("Invalid sweep: %v", err)
+	}
+	sw, err := openSweep(spec, *out)
+	if err != nil {
+		log.Fatalf("Failed to set up sweep: %v", err)
+	}
+	if err := sw.run(*parallel); err != nil {
+		log.Fatalf("Sweep failed: %v", err)
+	}
+}
+
+// LoadSweepSpec reads a sweep spec. The base config in it holds any subset of
+// the run parameters, like a config file.
+func LoadSweepSpec(filename string) (SweepSpec, error) {
+	spec := SweepSpec{Config: DefaultConfig(), Replicates: 1, Seed: 1}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return spec, fmt.Errorf("failed to read sweep spec: %w", err)
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return spec, fmt.Errorf("failed to parse sweep spec %s: %w", filename, err)
+	}
+	if spec.ISA == "" {
+		spec.ISA = vm.DefaultISAName
+	}
+	if spec.Schedule == "" {
+		spec.Schedule = PolicyRandom
+	}
+	if spec.Memory == "" {
+		spec.Memory = vm.MemoryRacy
+	}
+	return spec, spec.Validate()
+}
+
+// Validate checks the spec apart from the configs of the runs, which are
+// checked as they are expanded.
+func (spec SweepSpec) Validate() error {
+	if _, err := spec.duration(); err != nil {
+		return err
+	}
+	if spec.Duration == "" && !(spec.Deterministic && spec.Rounds > 0) {
+		return fmt.Errorf("runs need a duration, or rounds in deterministic mode")
+	}
+	if spec.Rounds > 0 && !spec.Deterministic {
+		return fmt.Errorf("rounds only apply to deterministic runs")
+	}
+	if spec.Replicates < 1 {
+		return fmt.Errorf("replicates must be at least 1, got %d", spec.Replicates)
+	}
+	if _, err := vm.LookupISA(spec.ISA); err != nil {
+		return err
+	}
+	// The run's own AppState checks the policy and model again, along with
+	// their combination.
+	probe := NewAppState(DefaultConfig())
+	if err := probe.SetSchedule(spec.Schedule, 0); err != nil {
+		return err
+	}
+	return probe.SetMemoryModel(spec.Memory)
+}
+
+// duration returns the run time of each run, 0 if runs end by rounds only.
+func (spec SweepSpec) duration() (time.Duration, error) {
+	if spec.Duration == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(spec.Duration)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", spec.Duration)
+	}
+	return d, nil
+}
+
+// points returns the parameter combinations of the spec, grid first.
+func (spec SweepSpec) points() []SweepPoint {
+	a := spec.Grid
+	points := []SweepPoint{{}}
+	gridded := false
+	expand := func(n int, set func(p *SweepPoint, i int)) {
+		if n == 0 {
+			return
+		}
+		gridded = true
+		var next []SweepPoint
+		for _, p := range points {
+			for i := 0; i < n; i++ {
+				q := p
+				set(&q, i)
+				next = append(next, q)
+			}
+		}
+		points = next
+	}
+	expand(len(a.Seed), func(p *SweepPoint, i int) { p.Seed = &a.Seed[i] })
+	expand(len(a.CosmicRayRate), func(p *SweepPoint, i int) { p.CosmicRayRate = &a.CosmicRayRate[i] })
+	expand(len(a.Addressing), func(p *SweepPoint, i int) { p.Addressing = a.Addressing[i] })
+	expand(len(a.IPs), func(p *SweepPoint, i int) { p.IPs = &a.IPs[i] })
+	expand(len(a.VisDim), func(p *SweepPoint, i int) { p.VisDim = &a.VisDim[i] })
+	expand(len(a.SoupGridDim), func(p *SweepPoint, i int) { p.SoupGridDim = &a.SoupGridDim[i] })
+
+	if len(spec.List) > 0 {
+		if !gridded {
+			points = nil
+		}
+		points = append(points, spec.List...)
+	}
+	return points
+}
+
+// apply returns the base config with the point's parameters.
+func (p SweepPoint) apply(cfg Config) (Config, error) {
+	if p.CosmicRayRate != nil {
+		cfg.CosmicRayRate = *p.CosmicRayRate
+	}
+	if p.Addressing != "" {
+		modes, ok := sweepAddressing[p.Addressing]
+		if !ok {
+			return cfg, fmt.Errorf("unknown addressing %q (available: relative, relative32, absolute, absolute32)", p.Addressing)
+		}
+		cfg.Use32BitAddressing, cfg.UseRelativeAddressing = modes[0], modes[1]
+	}
+	if p.IPs != nil {
+		cfg.InitialIPs = *p.IPs
+	}
+	if p.VisDim != nil {
+		cfg.VisDim = *p.VisDim
+	}
+	if p.SoupGridDim != nil {
+		cfg.SoupGridDim = *p.SoupGridDim
+	}
+	return cfg, cfg.Validate()
+}
+
+// runs expands the spec into its runs. Replicates of a point with a swept
+// seed use consecutive seeds from it, the other runs take consecutive seeds
+// from the spec's seed.
+func (spec SweepSpec) runs() ([]SweepRunRecord, error) {
+	var runs []SweepRunRecord
+	nextSeed := spec.Seed
+	for _, p := range spec.points() {
+		cfg, err := p.apply(spec.Config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sweep point %+v: %w", p, err)
+		}
+		for r := 0; r < spec.Replicates; r++ {
+			seed := nextSeed
+			if p.Seed != nil {
+				seed = *p.Seed + int64(r)
+			} else {
+				nextSeed++
+			}
+			id := fmt.Sprintf("run_%04d", len(runs)+1)
+			runs = append(runs, SweepRunRecord{
+				ID:        id,
+				Dir:       id,
+				Point:     p,
+				Replicate: r,
+				Seed:      seed,
+				Config:    cfg,
+				Status:    RunPending,
+			})
+		}
+	}
+	return runs, nil
+}
+
+// sweep is a sweep being run in a directory.
+type sweep struct {
+	dir      string
+	mu       sync.Mutex // Guards manifest
+	manifest SweepManifest
+}
+
+// openSweep prepares the sweep directory. If it holds the manifest of the same
+// sweep, the runs that did not finish are run again; any other manifest is an
+// error.
+func openSweep(spec SweepSpec, dir string) (*sweep, error) {
+	runs, err := spec.runs()
+	if err != nil {
+		return nil, err
+	}
+	sw := &sweep{dir: dir, manifest: SweepManifest{Spec: spec, Runs: runs}}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create sweep directory: %w", err)
+	}
+
+	data, err := os.ReadFile(sw.manifestPath())
+	if err == nil {
+		var previous SweepManifest
+		if err := json.Unmarshal(data, &previous); err != nil {
+			return nil, fmt.Errorf("failed to parse sweep manifest: %w", err)
+		}
+		if !sameRuns(previous.Runs, runs) {
+			return nil, fmt.Errorf("%s holds a different sweep, use another -out directory", dir)
+		}
+		done := 0
+		for i, run := range previous.Runs {
+			if run.Status == RunDone {
+				sw.manifest.Runs[i] = run
+				done++
+			}
+		}
+		log.Printf("Resuming sweep in %s: %d of %d runs done.", dir, done, len(runs))
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read sweep manifest: %w", err)
+	}
+	return sw, sw.save()
+}
+
+// sameRuns reports whether two manifests describe the same runs.
+func sameRuns(a, b []SweepRunRecord) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID || a[i].Seed != b[i].Seed || a[i].Config != b[i].Config {
+			return false
+		}
+	}
+	return true
+}
+
+func (sw *sweep) manifestPath() string {
+	return filepath.Join(sw.dir, "manifest.json")
+}
+
+// save writes the manifest, replacing the previous one in a single rename.
+// The caller must hold mu, or be the only user.
+func (sw *sweep) save() error {
+	data, err := json.MarshalIndent(sw.manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode sweep manifest: %w", err)
+	}
+	tmp := sw.manifestPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write sweep manifest: %w", err)
+	}
+	if err := os.Rename(tmp, sw.manifestPath()); err != nil {
+		return fmt.Errorf("failed to move sweep manifest into place: %w", err)
+	}
+	return nil
+}
+
+// update changes a run's record and saves the manifest.
+func (sw *sweep) update(i int, change func(r *SweepRunRecord)) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	change(&sw.manifest.Runs[i])
+	if err := sw.save(); err != nil {
+		log.Printf("Error saving sweep manifest: %v", err)
+	}
+}
+
+// run executes the runs that are not done, parallel at a time.
+func (sw *sweep) run(parallel int) error {
+	spec := sw.manifest.Spec
+	workers := spec.Workers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0) / parallel
+		if workers < 1 {
+			workers = 1
+		}
+	}
+
+	pending := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range pending {
+				sw.execute(i, workers)
+			}
+		}()
+	}
+	for i, run := range sw.manifest.Runs {
+		if run.Status != RunDone {
+			pending <- i
+		}
+	}
+	close(pending)
+	wg.Wait()
+
+	failed := 0
+	for _, run := range sw.manifest.Runs {
+		if run.Status != RunDone {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d runs failed, see %s", failed, len(sw.manifest.Runs), sw.manifestPath())
+	}
+	log.Printf("Sweep finished: %d runs in %s.", len(sw.manifest.Runs), sw.dir)
+	return nil
+}
+
+// execute performs one run and records the outcome in the manifest.
+func (sw *sweep) execute(i int, workers int) {
+	sw.mu.Lock()
+	run := sw.manifest.Runs[i]
+	sw.mu.Unlock()
+	started := time.Now()
+	sw.update(i, func(r *SweepRunRecord) {
+		r.Status, r.Error, r.Started, r.Finished, r.Final = RunRunning, "", &started, nil, nil
+	})
+	log.Printf("Sweep %s: starting, seed %d, point %s.", run.ID, run.Seed, describePoint(run.Point))
+
+	final, err := runSweepRun(sw.manifest.Spec, run, filepath.Join(sw.dir, run.Dir), workers)
+	finished := time.Now()
+	sw.update(i, func(r *SweepRunRecord) {
+		r.Finished = &finished
+		r.Final = final
+		if err != nil {
+			r.Status, r.Error = RunFailed, err.Error()
+		} else {
+			r.Status = RunDone
+		}
+	})
+	if err != nil {
+		log.Printf("Sweep %s: failed: %v", run.ID, err)
+		return
+	}
+	log.Printf("Sweep %s: done in %s.", run.ID, finished.Sub(started).Round(time.Second))
+}
+
+// runSweepRun runs a simulation in the process, writing its metrics and final
+// snapshot to dir. Files of an earlier, interrupted attempt are replaced.
+func runSweepRun(spec SweepSpec, run SweepRunRecord, dir string, workers int) (*GenerationStats, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to clear run directory: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create run directory: %w", err)
+	}
+
+	appState := NewAppState(run.Config)
+	appState.Deterministic = spec.Deterministic
+	appState.roundLimit = spec.Rounds
+	if err := appState.SetISA(spec.ISA); err != nil {
+		return nil, err
+	}
+	if err := appState.SetSchedule(spec.Schedule, workers); err != nil {
+		return nil, err
+	}
+	if err := appState.SetMemoryModel(spec.Memory); err != nil {
+		return nil, err
+	}
+	appState.initializeSimulation(run.Seed)
+
+	metrics, err := OpenMetrics(filepath.Join(dir, "metrics.csv"), 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	appState.OnStats(metrics.Observe)
+
+	appState.LaunchIPs()
+	go appState.RunStatistics(nil)
+	var timeout <-chan time.Time
+	if d, _ := spec.duration(); d > 0 {
+		timeout = time.After(d)
+	}
+	select {
+	case <-timeout:
+	case <-appState.Finished():
+	}
+	appState.Stop()
+
+	var final *GenerationStats
+	if history := appState.statsHistory(); len(history) > 0 {
+		final = &history[len(history)-1]
+	}
+	if err := metrics.Close(); err != nil {
+		return final, err
+	}
+	if err := appState.saveSnapshot(filepath.Join(dir, "snapshot.gob")); err != nil {
+		return final, err
+	}
+	return final, nil
+}
+
+// describePoint formats the parameters a point sets.
+func describePoint(p SweepPoint) string {
+	data, _ := json.Marshal(p)
+	return string(data)
+}
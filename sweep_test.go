@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"evolution/vm"
+)
+
+func TestSweepRuns(t *testing.T) {
+	seeds := []int64{10, 20}
+	rate := 0.5
+	spec := SweepSpec{
+		Config:     DefaultConfig(),
+		Replicates: 2,
+		Seed:       100,
+		Grid:       SweepAxes{Seed: seeds, Addressing: []string{"relative", "absolute32"}},
+		List:       []SweepPoint{{CosmicRayRate: &rate}},
+	}
+	runs, err := spec.runs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two seeds by two addressing modes, then the list entry, two times each.
+	wantSeeds := []int64{10, 11, 10, 11, 20, 21, 20, 21, 100, 101}
+	if len(runs) != len(wantSeeds) {
+		t.Fatalf("got %d runs, want %d", len(runs), len(wantSeeds))
+	}
+	for i, run := range runs {
+		if run.Seed != wantSeeds[i] || run.Replicate != i%2 || run.Status != RunPending {
+			t.Errorf("run %d: %+v", i, run)
+		}
+	}
+	if cfg := runs[2].Config; cfg.UseRelativeAddressing || !cfg.Use32BitAddressing {
+		t.Errorf("absolute32 run has config %+v", cfg)
+	}
+	if cfg := runs[8].Config; cfg.CosmicRayRate != 0.5 || !cfg.UseRelativeAddressing {
+		t.Errorf("list run has config %+v", cfg)
+	}
+
+	spec.List = []SweepPoint{{Addressing: "sideways"}}
+	if _, err := spec.runs(); err == nil {
+		t.Error("runs accepted an unknown addressing mode")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.VisDim = 32
+	cfg.InitialIPs = 16
+	seed := int64(5)
+	// The same run twice, from the grid and from the list.
+	spec := SweepSpec{
+		Config:        cfg,
+		Deterministic: true,
+		Rounds:        50,
+		ISA:           vm.DefaultISAName,
+		Schedule:      PolicyRandom,
+		Memory:        vm.MemoryRacy,
+		Replicates:    1,
+		Grid:          SweepAxes{Seed: []int64{seed}},
+		List:          []SweepPoint{{Seed: &seed}},
+	}
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	sw, err := openSweep(spec, dir)
+	if err != nil {
+		t.Fatalf("openSweep: %v", err)
+	}
+	if err := sw.run(2); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	var soups [][]int8
+	for _, run := range sw.manifest.Runs {
+		if run.Status != RunDone || run.Finished == nil {
+			t.Errorf("run %s: %+v", run.ID, run)
+		}
+		state, err := readSnapshot(filepath.Join(dir, run.Dir, "snapshot.gob"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Rounds != spec.Rounds {
+			t.Errorf("run %s stopped after %d rounds, want %d", run.ID, state.Rounds, spec.Rounds)
+		}
+		soups = append(soups, state.Soup)
+	}
+	if !reflect.DeepEqual(soups[0], soups[1]) {
+		t.Error("runs with the same seed ended with different soups")
+	}
+
+	// Reopening resumes the sweep, which is done.
+	again, err := openSweep(spec, dir)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	for _, run := range again.manifest.Runs {
+		if run.Status != RunDone {
+			t.Errorf("run %s is %s after reopening, want done", run.ID, run.Status)
+		}
+	}
+
+	// A different sweep does not take over the directory.
+	spec.Grid.Seed = []int64{6}
+	if _, err := openSweep(spec, dir); err == nil {
+		t.Error("openSweep accepted a directory holding another sweep")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Timeline keeps a rolling in-memory history of the run so it can be rewound.
+// At every interval it records a point: a full checkpoint of the simulation
+// state every few points, and in between only the soup cells that changed
+// since the previous point, along with the IPs and counters. Points that fall
+// out of the window are dropped, and the oldest remaining point is turned into
+// a checkpoint if it is not one already.
+type Timeline struct {
+	appState *AppState
+
+	mu              sync.Mutex
+	points          []timelinePoint // Oldest first, the first is always a checkpoint
+	soup            []int8          // Soup at the newest point, to diff against
+	sinceCheckpoint int             // Points recorded since the newest checkpoint
+}
+
+// timelinePoint is the simulation state at one moment of the timeline. Its
+// state carries no statistics history, and no soup unless it is a checkpoint.
+type timelinePoint struct {
+	state      SimulationState
+	checkpoint bool
+	changes    []cellChange // Cells changed since the previous point
+	historyLen int          // Statistics reports recorded at the time
+}
+
+// cellChange is a soup cell and the value it changed to.
+type cellChange struct {
+	index int32
+	value int8
+}
+
+// TimelinePointInfo describes a recorded point to the frontend.
+type TimelinePointInfo struct {
+	Elapsed    float64 `json:"elapsed"` // Seconds of run time
+	Checkpoint bool    `json:"checkpoint"`
+	Changes    int     `json:"changes"` // Cells changed since the previous point
+}
+
+// NewTimeline creates an empty timeline for a run.
+func NewTimeline(appState *AppState) *Timeline {
+	return &Timeline{appState: appState}
+}
+
+// elapsed returns the run time of the point.
+func (p *timelinePoint) elapsed() time.Duration {
+	return time.Duration(p.state.TimeElapsed) * time.Microsecond
+}
+
+// Run records a point at the configured interval until the process exits. It
+// returns at once if the timeline is disabled.
+func (t *Timeline) Run() {
+	interval := t.appState.config.TimelineInterval
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.record()
+	}
+}
+
+// record captures the simulation state and appends it to the timeline.
+func (t *Timeline) record() {
+	state := t.appState.captureSnapshot()
+	point := timelinePoint{historyLen: len(state.History)}
+	state.History = nil
+
+	cfg := t.appState.config
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.points) == 0 || len(state.Soup) != len(t.soup) || t.sinceCheckpoint+1 >= cfg.TimelineCheckpoint {
+		point.checkpoint = true
+		t.sinceCheckpoint = 0
+	} else {
+		for i, v := range state.Soup {
+			if v != t.soup[i] {
+				point.changes = append(point.changes, cellChange{index: int32(i), value: v})
+			}
+		}
+		t.sinceCheckpoint++
+	}
+	t.soup = state.Soup
+	if !point.checkpoint {
+		state.Soup = nil
+	}
+	point.state = state
+	t.points = append(t.points, point)
+	t.prune(time.Duration(cfg.TimelineWindow) * time.Second)
+}
+
+// prune drops the points older than the window before the newest one.
+func (t *Timeline) prune(window time.Duration) {
+	cutoff := t.points[len(t.points)-1].elapsed() - window
+	first := 0
+	for first < len(t.points)-1 && t.points[first].elapsed() < cutoff {
+		first++
+	}
+	if first == 0 {
+		return
+	}
+	if !t.points[first].checkpoint {
+		t.points[first].state.Soup = t.soupAt(first)
+		t.points[first].checkpoint = true
+		t.points[first].changes = nil
+	}
+	t.points = append(t.points[:0], t.points[first:]...)
+}
+
+// soupAt rebuilds the soup of point i from the checkpoint before it.
+func (t *Timeline) soupAt(i int) []int8 {
+	c := i
+	for !t.points[c].checkpoint {
+		c--
+	}
+	soup := append([]int8(nil), t.points[c].state.Soup...)
+	for _, p := range t.points[c+1 : i+1] {
+		for _, change := range p.changes {
+			soup[change.index] = change.value
+		}
+	}
+	return soup
+}
+
+// Points describes the recorded points, oldest first.
+func (t *Timeline) Points() []TimelinePointInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	infos := make([]TimelinePointInfo, len(t.points))
+	for i, p := range t.points {
+		infos[i] = TimelinePointInfo{
+			Elapsed:    p.elapsed().Seconds(),
+			Checkpoint: p.checkpoint,
+			Changes:    len(p.changes),
+		}
+	}
+	return infos
+}
+
+// Rewind restores the latest point at least d before the current run time.
+func (t *Timeline) Rewind(d time.Duration) (time.Duration, error) {
+	return t.seek(func() time.Duration { return t.appState.elapsed() - d })
+}
+
+// Seek restores the latest point at or before the given run time, or the
+// oldest point if there is none.
+func (t *Timeline) Seek(target time.Duration) (time.Duration, error) {
+	return t.seek(func() time.Duration { return target })
+}
+
+// seek restores a point and returns its run time. The run continues from
+// there, so the points after it are forgotten.
+func (t *Timeline) seek(target func() time.Duration) (time.Duration, error) {
+	s := t.appState
+	var restored time.Duration
+	var err error
+	s.quiesce(func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if len(t.points) == 0 {
+			if s.config.TimelineInterval <= 0 {
+				err = fmt.Errorf("the timeline is disabled, see -timeline-interval")
+				return
+			}
+			err = fmt.Errorf("no points recorded yet")
+			return
+		}
+		to := target()
+		i := 0
+		for i+1 < len(t.points) && t.points[i+1].elapsed() <= to {
+			i++
+		}
+
+		state := t.points[i].state
+		state.Soup = t.soupAt(i)
+		history := s.statsHistory()
+		if len(history) > t.points[i].historyLen {
+			history = history[:t.points[i].historyLen]
+		}
+		state.History = history
+		if err = s.restoreSnapshot(state); err != nil {
+			err = fmt.Errorf("failed to restore timeline point: %w", err)
+			return
+		}
+		s.refreshObservers()
+
+		t.points = t.points[:i+1]
+		t.soup = state.Soup
+		t.sinceCheckpoint = 0
+		for c := i; !t.points[c].checkpoint; c-- {
+			t.sinceCheckpoint++
+		}
+		restored = t.points[i].elapsed()
+	})
+	if err == nil {
+		log.Printf("Rewound to %s of run time.", restored.Round(time.Second))
+		select {
+		case s.visRequestChan <- struct{}{}:
+		default:
+		}
+	}
+	return restored, err
+}
+
+// handleTimeTravel carries out a timeline request from the frontend and
+// broadcasts the timeline, with the restored parameters after a rewind.
+func handleTimeTravel(hub *Hub, appState *AppState, timeline *Timeline, req TimeTravelRequest) {
+	msg := TimelineMessage{Type: "timeline"}
+	var restored time.Duration
+	var err error
+	switch req.Command {
+	case "list":
+	case "rewind":
+		restored, err = timeline.Rewind(time.Duration(req.Seconds * float64(time.Second)))
+	case "seek":
+		restored, err = timeline.Seek(time.Duration(req.Seconds * float64(time.Second)))
+	default:
+		err = fmt.Errorf("unknown timeline command %q", req.Command)
+	}
+	if err != nil {
+		log.Printf("Timeline: %v", err)
+		msg.Error = err.Error()
+	} else if req.Command != "list" {
+		seconds := restored.Seconds()
+		msg.Restored = &seconds
+		if jsonData, err := simParams(appState); err == nil {
+			hub.Broadcast <- jsonData
+		}
+		if atomic.LoadInt32(&appState.paused) == 1 {
+			broadcastDebugState(hub, appState, "")
+		}
+	}
+	msg.Points = timeline.Points()
+	msg.Elapsed = appState.elapsed().Seconds()
+	jsonData, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("error marshalling timeline message: %v", err)
+		return
+	}
+	hub.Broadcast <- jsonData
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimelineRebuildsSoups(t *testing.T) {
+	s := newTestAppState(t, 1, func(s *AppState) {
+		s.config.TimelineCheckpoint = 4
+		s.config.TimelineWindow = 5
+	})
+	// Paused, so recording does not launch the IPs.
+	atomic.StoreInt32(&s.paused, 1)
+	timeline := NewTimeline(s)
+	soups := map[time.Duration][]int8{} // Expected soup by whole second of run time
+	r := rand.New(rand.NewSource(1))
+
+	// A point every two seconds keeps the points off the window's edge.
+	for second := 0; second < 40; second += 2 {
+		for i := 0; i < 10; i++ {
+			s.soup[r.Intn(len(s.soup))] = int8(r.Intn(256))
+		}
+		s.timeElapsed = int64(second) * int64(time.Second/time.Microsecond)
+		s.startTime = time.Now()
+		timeline.record()
+		soups[time.Duration(second)*time.Second] = append([]int8(nil), s.soup...)
+
+		points := timeline.points
+		if !points[0].checkpoint {
+			t.Fatalf("second %d: the oldest point is not a checkpoint", second)
+		}
+		oldest := points[0].elapsed().Truncate(time.Second)
+		if newest := points[len(points)-1].elapsed().Truncate(time.Second); newest-oldest > 5*time.Second {
+			t.Errorf("second %d: points span %s, more than the window", second, newest-oldest)
+		}
+		for i, p := range points {
+			if want := soups[p.elapsed().Truncate(time.Second)]; !reflect.DeepEqual(timeline.soupAt(i), want) {
+				t.Errorf("second %d: soup of point %d at %s does not match the recorded one", second, i, p.elapsed())
+			}
+		}
+	}
+	if n := len(timeline.points); n != 3 {
+		t.Errorf("kept %d points, want the 3 of the window", n)
+	}
+}
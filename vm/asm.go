@@ -0,0 +1,133 @@
+package vm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Assembler source is the same grid that FormatDisassembly prints: one soup
+// row per line, cells separated by '|'. A cell is either an instruction,
+//
+//	OP src1, src2 -> dest
+//
+// with src1 one of N or *N, src2 one of E or *E and dest one of S1, S2, self
+// or jmp, or a raw byte written as a number in [-128, 255] (decimal or 0x
+// hex), which is how data such as pointer offsets is placed. Text after '#'
+// or ';' is a comment and blank lines are ignored.
+
+// Assemble encodes source text into rows of soup bytes for the given ISA.
+// Rows may have different lengths. Errors name the line and cell at fault.
+func Assemble(isa ISA, src string) ([][]int8, error) {
+	encodings := encodingTable(isa)
+	var rows [][]int8
+	for lineNo, line := range strings.Split(src, "\n") {
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		cells := strings.Split(line, "|")
+		row := make([]int8, 0, len(cells))
+		for cellNo, cell := range cells {
+			b, err := assembleCell(isa, encodings, cell)
+			if err != nil {
+				return nil, fmt.Errorf("line %d, cell %d: %w", lineNo+1, cellNo+1, err)
+			}
+			row = append(row, b)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("program is empty")
+	}
+	return rows, nil
+}
+
+// AssembleInstruction encodes a single cell, an instruction or a raw byte.
+func AssembleInstruction(isa ISA, text string) (int8, error) {
+	return assembleCell(isa, encodingTable(isa), text)
+}
+
+// encodingTable maps the canonical text of every instruction of an ISA to the
+// lowest byte that decodes to it.
+func encodingTable(isa ISA) map[string]int8 {
+	table := mnemonicTable(isa)
+	encodings := make(map[string]int8, len(table))
+	for b := 255; b >= 0; b-- {
+		encodings[table[b]] = int8(b)
+	}
+	return encodings
+}
+
+func assembleCell(isa ISA, encodings map[string]int8, cell string) (int8, error) {
+	text := strings.TrimSpace(cell)
+	if text == "" {
+		return 0, fmt.Errorf("empty cell")
+	}
+	if c := text[0]; c == '-' || c == '+' || (c >= '0' && c <= '9') {
+		v, err := strconv.ParseInt(text, 0, 16)
+		if err != nil || v < -128 || v > 255 {
+			return 0, fmt.Errorf("invalid byte %q, must be a number in [-128, 255]", text)
+		}
+		return int8(v), nil
+	}
+
+	// OP src1, src2 -> dest
+	arrow := strings.Index(text, "->")
+	if arrow < 0 {
+		return 0, fmt.Errorf("%q: missing '-> dest'", text)
+	}
+	dest := strings.TrimSpace(text[arrow+2:])
+	fields := strings.Fields(text[:arrow])
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("%q: missing mnemonic", text)
+	}
+	name := strings.ToUpper(fields[0])
+	operands := strings.Split(strings.Join(fields[1:], ""), ",")
+	if len(operands) != 2 {
+		return 0, fmt.Errorf("%q: want two source operands, got %d", text, len(operands))
+	}
+
+	known := false
+	for _, op := range isa.Opcodes() {
+		if op.Name == name {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return 0, fmt.Errorf("unknown mnemonic %q for instruction set %s", fields[0], isa.Name())
+	}
+	src1, err := matchName(operands[0], src1Names[:], "source 1")
+	if err != nil {
+		return 0, err
+	}
+	src2, err := matchName(operands[1], src2Names[:], "source 2")
+	if err != nil {
+		return 0, err
+	}
+	d, err := matchName(dest, destNames[:], "destination")
+	if err != nil {
+		return 0, err
+	}
+
+	canonical := name + " " + src1 + ", " + src2 + " -> " + d
+	b, ok := encodings[canonical]
+	if !ok {
+		return 0, fmt.Errorf("%q cannot be encoded in instruction set %s", text, isa.Name())
+	}
+	return b, nil
+}
+
+// matchName returns the canonical spelling of s among names, ignoring case.
+func matchName(s string, names []string, what string) (string, error) {
+	s = strings.TrimSpace(s)
+	for _, name := range names {
+		if strings.EqualFold(s, name) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("invalid %s %q, must be one of %s", what, s, strings.Join(names, ", "))
+}
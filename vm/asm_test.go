@@ -0,0 +1,107 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAssembleDisassembleRoundTrip(t *testing.T) {
+	for _, name := range ISANames() {
+		isa, err := LookupISA(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(name, func(t *testing.T) {
+			// One row per opcode, holding every operand and destination
+			// combination, so the program covers the whole instruction set.
+			var rows [][]string
+			for _, op := range isa.Opcodes() {
+				var row []string
+				for _, s1 := range src1Names {
+					for _, s2 := range src2Names {
+						for _, d := range destNames {
+							row = append(row, op.Name+" "+s1+", "+s2+" -> "+d)
+						}
+					}
+				}
+				rows = append(rows, row)
+			}
+			rows = append(rows, []string{"0", "-128", "127", "0x7f"})
+
+			src := FormatDisassembly(rows)
+			program, err := Assemble(isa, src)
+			if err != nil {
+				t.Fatalf("Assemble: %v", err)
+			}
+			if len(program) != len(rows) {
+				t.Fatalf("got %d rows, want %d", len(program), len(rows))
+			}
+			for y, row := range rows[:len(rows)-1] {
+				if len(program[y]) != len(row) {
+					t.Fatalf("row %d: got %d cells, want %d", y, len(program[y]), len(row))
+				}
+				got := Disassemble(isa, program[y], int32(len(row)), 0, 0, int32(len(row)), 1)[0]
+				for x, want := range row {
+					if got[x] != want {
+						t.Errorf("row %d, cell %d: disassembled to %q, want %q", y, x, got[x], want)
+					}
+				}
+			}
+			if raw := program[len(program)-1]; raw[0] != 0 || raw[1] != -128 || raw[2] != 127 || raw[3] != 127 {
+				t.Errorf("raw bytes assembled to %v", raw)
+			}
+
+			// Every byte disassembles to text that assembles back to it, or to
+			// a byte with the same meaning.
+			for b := 0; b < 256; b++ {
+				text := DisassembleInstruction(isa, int8(b))
+				got, err := AssembleInstruction(isa, text)
+				if err != nil {
+					t.Errorf("byte %d: %q: %v", b, text, err)
+					continue
+				}
+				if again := DisassembleInstruction(isa, got); again != text {
+					t.Errorf("byte %d: %q assembled to %d, which disassembles to %q", b, text, got, again)
+				}
+			}
+		})
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	isa, err := LookupISA(DefaultISAName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		src  string
+		want string // Substring of the error
+	}{
+		{"unknown mnemonic", "FOO N, E -> S1", `unknown mnemonic "FOO"`},
+		{"mnemonic of another ISA", "SHL N, E -> S1", `unknown mnemonic "SHL"`},
+		{"bad source 1", "ADD X, E -> S1", `invalid source 1 "X"`},
+		{"bad source 2", "ADD N, N -> S1", `invalid source 2 "N"`},
+		{"bad destination", "ADD N, E -> S3", `invalid destination "S3"`},
+		{"missing destination", "ADD N, E", "missing '-> dest'"},
+		{"destination only", "-> S1", `invalid byte "-> S1"`},
+		{"one source operand", "ADD N -> S1", "want two source operands, got 1"},
+		{"three source operands", "ADD N, E, E -> S1", "want two source operands, got 3"},
+		{"byte out of range", "256", `invalid byte "256"`},
+		{"byte not a number", "12abc", `invalid byte "12abc"`},
+		{"empty cell", "ADD N, E -> S1 |", "empty cell"},
+		{"empty program", "# comment\n\n", "program is empty"},
+		{"error position", "ADD N, E -> S1\nADD N, E -> S1 | FOO N, E -> S1", "line 2, cell 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := Assemble(isa, tt.src)
+			if err == nil {
+				t.Fatalf("Assemble(%q) = %v, want an error", tt.src, rows)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Assemble(%q) error %q, want it to contain %q", tt.src, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package vm
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Operand and destination notation used by the disassembler and assembler.
+// Src1 is read from the north neighbour and Src2 from the east neighbour; a
+// leading '*' marks pointer mode. Destinations follow the Dest selector.
+var (
+	src1Names = [2]string{"N", "*N"}
+	src2Names = [2]string{"E", "*E"}
+	destNames = [4]string{"S1", "S2", "self", "jmp"}
+)
+
+// CellSeparator separates cells of a row in disassembly listings and in
+// assembler source.
+const CellSeparator = " | "
+
+// mnemonicTable maps every byte value to its mnemonic under an ISA.
+func mnemonicTable(isa ISA) [256]string {
+	names := make(map[uint8]string)
+	for _, op := range isa.Opcodes() {
+		names[op.Value] = op.Name
+	}
+	var table [256]string
+	for b := 0; b < 256; b++ {
+		d := isa.Decode(uint8(b))
+		name, ok := names[d.Op]
+		if !ok || int(d.Dest) >= len(destNames) {
+			// Not an instruction of this ISA, show the raw value.
+			table[b] = strconv.Itoa(int(int8(b)))
+			continue
+		}
+		table[b] = name + " " + src1Names[boolIndex(d.S1Ptr)] + ", " + src2Names[boolIndex(d.S2Ptr)] + " -> " + destNames[d.Dest]
+	}
+	return table
+}
+
+func boolIndex(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// DisassembleInstruction renders a single byte, for example "ADD *N, E -> self".
+func DisassembleInstruction(isa ISA, instruction int8) string {
+	table := mnemonicTable(isa)
+	return table[uint8(instruction)]
+}
+
+// Disassemble renders the w x h rectangle of the soup whose top-left cell is
+// (x, y) as one mnemonic per cell, row by row. Coordinates wrap around the
+// soup edges like IP movement does.
+func Disassemble(isa ISA, soup []int8, soupDimX, x, y, w, h int32) [][]string {
+	table := mnemonicTable(isa)
+	soupDimY := int32(len(soup)) / soupDimX
+	rows := make([][]string, h)
+	for dy := int32(0); dy < h; dy++ {
+		row := make([]string, w)
+		sy := ((y+dy)%soupDimY + soupDimY) % soupDimY
+		for dx := int32(0); dx < w; dx++ {
+			sx := ((x+dx)%soupDimX + soupDimX) % soupDimX
+			row[dx] = table[uint8(soup[sy*soupDimX+sx])]
+		}
+		rows[dy] = row
+	}
+	return rows
+}
+
+// FormatDisassembly lays out disassembled rows as a text grid with aligned
+// columns. The output is valid assembler source.
+func FormatDisassembly(rows [][]string) string {
+	var widths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			if len(cell) > widths[i] {
+				widths[i] = len(cell)
+			}
+		}
+	}
+	var sb strings.Builder
+	for _, row := range rows {
+		for i, cell := range row {
+			if i > 0 {
+				sb.WriteString(CellSeparator)
+			}
+			sb.WriteString(cell)
+			if i < len(row)-1 {
+				sb.WriteString(strings.Repeat(" ", widths[i]-len(cell)))
+			}
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
@@ -0,0 +1,189 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// DefaultISAName is the instruction set used when none is selected.
+const DefaultISAName = "classic"
+
+// Decoded holds the fields of an instruction byte that IP.Step needs to run
+// it: the ALU op, the pointer-mode flags of the two sources and the
+// destination selector (0: Src1, 1: Src2, 2: self, 3: the jump address).
+type Decoded struct {
+	Op    uint8
+	S1Ptr bool
+	S2Ptr bool
+	Dest  uint8
+}
+
+// ISA is an instruction set architecture. IP.Step keeps the pointer
+// infrastructure (sources from the north and east neighbours, destination
+// selection, jumps and movement) and asks the ISA how to decode a byte and
+// what its ALU op computes.
+type ISA interface {
+	// Name identifies the ISA in flags, snapshots and the UI.
+	Name() string
+	// Decode splits an instruction byte into its fields.
+	Decode(instruction uint8) Decoded
+	// Execute runs the ALU op of a decoded instruction and reports the value
+	// to write and whether the IP jumps.
+	Execute(op uint8, instruction, src1Val, src2Val int8) (result int8, jumpTaken bool)
+	// Opcodes lists the ALU ops, for the UI and for disassembly.
+	Opcodes() []OpcodeInfo
+	// OpBits is the number of high bits of a byte holding the ALU op.
+	OpBits() int
+}
+
+var (
+	isaMu sync.RWMutex
+	isas  = make(map[string]ISA)
+)
+
+// RegisterISA makes an instruction set selectable by name. It panics if the
+// name is already taken, like the registries of the standard library.
+func RegisterISA(isa ISA) {
+	isaMu.Lock()
+	defer isaMu.Unlock()
+	if _, dup := isas[isa.Name()]; dup {
+		panic("vm: RegisterISA called twice for " + isa.Name())
+	}
+	isas[isa.Name()] = isa
+}
+
+// LookupISA returns the registered instruction set with the given name.
+func LookupISA(name string) (ISA, error) {
+	isaMu.RLock()
+	defer isaMu.RUnlock()
+	isa, ok := isas[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown instruction set %q (available: %v)", name, isaNamesLocked())
+	}
+	return isa, nil
+}
+
+// ISANames returns the names of all registered instruction sets, sorted.
+func ISANames() []string {
+	isaMu.RLock()
+	defer isaMu.RUnlock()
+	return isaNamesLocked()
+}
+
+func isaNamesLocked() []string {
+	names := make([]string, 0, len(isas))
+	for name := range isas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func defaultISA() ISA {
+	isa, err := LookupISA(DefaultISAName)
+	if err != nil {
+		panic(err)
+	}
+	return isa
+}
+
+func init() {
+	RegisterISA(classicISA{})
+	RegisterISA(shiftISA{})
+}
+
+// classicISA is the original EvoSoup instruction set, decoded as
+// [ALU_Op(4) | S1_Ptr(1) | S2_Ptr(1) | Destination(2)].
+type classicISA struct{}
+
+func (classicISA) Name() string { return DefaultISAName }
+
+func (classicISA) OpBits() int { return NumAluBits }
+
+func (classicISA) Opcodes() []OpcodeInfo { return GetOpcodes() }
+
+func (classicISA) Decode(instruction uint8) Decoded {
+	return Decoded{
+		Op:    (instruction >> 4) & 0x0F,
+		S1Ptr: (instruction>>3)&0x01 == 1,
+		S2Ptr: (instruction>>2)&0x01 == 1,
+		Dest:  instruction & 0x03,
+	}
+}
+
+func (classicISA) Execute(op uint8, instruction, src1Val, src2Val int8) (result int8, jumpTaken bool) {
+	switch op {
+	case OP_CPY:
+		result = instruction // Copy self
+	case OP_ADD:
+		result = src1Val + src2Val
+	case OP_SUB:
+		result = src1Val - src2Val
+	case OP_NAND:
+		result = ^(src1Val & src2Val)
+	case OP_OR:
+		result = src1Val | src2Val
+	case OP_AND:
+		result = src1Val & src2Val
+	case OP_XOR:
+		result = src1Val ^ src2Val
+	case OP_NOT_S1:
+		result = ^src1Val
+	case OP_MOV_S1:
+		result = src1Val
+	case OP_MOV_S2:
+		result = src2Val
+	case OP_INC_S1:
+		result = src1Val + 1
+	case OP_DEC_S1:
+		result = src1Val - 1
+	case OP_JMP:
+		jumpTaken = true
+		result = instruction // Copy self
+	case OP_JZ:
+		jumpTaken = src1Val == 0
+		result = instruction // Copy self
+	case OP_JNZ:
+		jumpTaken = src1Val != 0
+		result = instruction // Copy self
+	case OP_JNEG:
+		jumpTaken = src1Val < 0
+		result = instruction // Copy self
+	default:
+		// Undefined opcodes are CPYs
+		result = instruction // Copy self
+	}
+	return result, jumpTaken
+}
+
+// Opcodes specific to the shift ISA.
+const (
+	OP_SHL uint8 = OP_NOT_S1 // Src1 << (Src2 & 7)
+	OP_SHR uint8 = OP_MOV_S2 // Src1 >> (Src2 & 7), arithmetic
+)
+
+// shiftISA is the classic layout with NOT_S1 and MOV_S2 replaced by shifts,
+// trading two unary ops for ops that move bits between positions.
+type shiftISA struct {
+	classicISA
+}
+
+func (shiftISA) Name() string { return "shift" }
+
+func (shiftISA) Opcodes() []OpcodeInfo {
+	opcodes := GetOpcodes()
+	opcodes[OP_SHL].Name = "SHL"
+	opcodes[OP_SHR].Name = "SHR"
+	return opcodes
+}
+
+func (isa shiftISA) Execute(op uint8, instruction, src1Val, src2Val int8) (result int8, jumpTaken bool) {
+	switch op {
+	case OP_SHL:
+		return src1Val << (uint8(src2Val) & 7), false
+	case OP_SHR:
+		return src1Val >> (uint8(src2Val) & 7), false
+	}
+	return isa.classicISA.Execute(op, instruction, src1Val, src2Val)
+}
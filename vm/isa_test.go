@@ -0,0 +1,86 @@
+package vm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLookupISA(t *testing.T) {
+	if names := ISANames(); !reflect.DeepEqual(names, []string{"classic", "shift"}) {
+		t.Errorf("ISANames() = %v", names)
+	}
+	for _, name := range ISANames() {
+		isa, err := LookupISA(name)
+		if err != nil || isa.Name() != name {
+			t.Errorf("LookupISA(%q) = %v, %v", name, isa, err)
+		}
+	}
+	if _, err := LookupISA("nope"); err == nil || !strings.Contains(err.Error(), "available: [classic shift]") {
+		t.Errorf("LookupISA of an unknown name gave error %v", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice did not panic")
+		}
+	}()
+	RegisterISA(shiftISA{})
+}
+
+func TestISAExecute(t *testing.T) {
+	classic, _ := LookupISA("classic")
+	shift, _ := LookupISA("shift")
+	const instruction = 0x35
+	tests := []struct {
+		isa        ISA
+		op         uint8
+		src1, src2 int8
+		result     int8
+		jump       bool
+	}{
+		{classic, OP_CPY, 1, 2, instruction, false},
+		{classic, OP_ADD, 100, 100, -56, false},
+		{classic, OP_SUB, 1, 2, -1, false},
+		{classic, OP_NAND, 0x0F, 0x3C, ^0x0C, false},
+		{classic, OP_XOR, 0x0F, 0x3C, 0x33, false},
+		{classic, OP_NOT_S1, 0x0F, 0, ^0x0F, false},
+		{classic, OP_MOV_S2, 1, 2, 2, false},
+		{classic, OP_DEC_S1, -128, 0, 127, false},
+		{classic, OP_JMP, 1, 2, instruction, true},
+		{classic, OP_JZ, 0, 2, instruction, true},
+		{classic, OP_JZ, 1, 2, instruction, false},
+		{classic, OP_JNEG, -1, 2, instruction, true},
+		{shift, OP_SHL, 3, 2, 12, false},
+		{shift, OP_SHL, 1, 15, -128, false}, // Shift count taken mod 8
+		{shift, OP_SHR, -128, 7, -1, false}, // Arithmetic
+		{shift, OP_ADD, 1, 2, 3, false},     // Other ops as in classic
+		{shift, OP_JNZ, 1, 0, instruction, true},
+	}
+	for _, tt := range tests {
+		result, jump := tt.isa.Execute(tt.op, instruction, tt.src1, tt.src2)
+		if result != tt.result || jump != tt.jump {
+			t.Errorf("%s op %d (%d, %d) = %d, %v, want %d, %v", tt.isa.Name(), tt.op, tt.src1, tt.src2, result, jump, tt.result, tt.jump)
+		}
+	}
+}
+
+func TestISADecodeAndOpcodes(t *testing.T) {
+	classic, _ := LookupISA("classic")
+	shift, _ := LookupISA("shift")
+	want := Decoded{Op: 0xA, S1Ptr: true, S2Ptr: false, Dest: 2}
+	for _, isa := range []ISA{classic, shift} {
+		if got := isa.Decode(0xAA); got != want {
+			t.Errorf("%s decoded 0xAA as %+v, want %+v", isa.Name(), got, want)
+		}
+		if n := len(isa.Opcodes()); n != 1<<isa.OpBits() {
+			t.Errorf("%s has %d opcodes for %d op bits", isa.Name(), n, isa.OpBits())
+		}
+	}
+	if name := shift.Opcodes()[OP_SHL].Name; name != "SHL" {
+		t.Errorf("shift op %d is %s, want SHL", OP_SHL, name)
+	}
+	// Renaming the shift ops leaves the classic table alone.
+	if name := classic.Opcodes()[OP_NOT_S1].Name; name != "NOT_S1" {
+		t.Errorf("classic op %d is %s, want NOT_S1", OP_NOT_S1, name)
+	}
+}
@@ -0,0 +1,288 @@
+package vm
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Memory mediates the soup accesses made by IP.Step: the instruction fetch,
+// the operand and pointer reads, and the write of the result. Schedulers and
+// memory models use it to give soup accesses a defined meaning when IPs run
+// in parallel.
+//
+// Step calls Begin before fetching, then Load and Store, then Commit. If
+// Commit returns false the step conflicted with another IP and is executed
+// again from the fetch.
+type Memory interface {
+	Begin()
+	Load(addr int32) int8
+	Store(addr int32, val int8)
+	Commit() bool
+}
+
+func (ip *IP) load(addr int32) int8 {
+	if ip.Memory != nil {
+		return ip.Memory.Load(addr)
+	}
+	return ip.Soup[addr]
+}
+
+func (ip *IP) store(addr int32, val int8) {
+	if ip.Memory != nil {
+		ip.Memory.Store(addr, val)
+		return
+	}
+	ip.Soup[addr] = val
+}
+
+// Memory consistency models for soup writes.
+const (
+	MemoryRacy          = "racy"          // Plain unsynchronized accesses, as IPs have always run
+	MemoryAtomic        = "atomic"        // Every cell access is atomic
+	MemoryStriped       = "striped"       // Every cell access holds the lock of its stripe of cells
+	MemoryTransactional = "transactional" // Each step reads, executes and writes as one transaction
+)
+
+// MemoryModels lists the available memory consistency models.
+var MemoryModels = []string{MemoryRacy, MemoryAtomic, MemoryStriped, MemoryTransactional}
+
+// MemoryModel hands out the Memory each IP accesses the soup through.
+type MemoryModel interface {
+	Name() string
+	// ForIP returns the Memory for one IP, or nil for direct access.
+	ForIP() Memory
+}
+
+// NewSoup allocates a soup of n cells whose backing array can be accessed a
+// 32-bit word at a time, as the atomic and transactional models require.
+func NewSoup(n int) []int8 {
+	capacity := (n + 3) &^ 3
+	if capacity < 16 {
+		capacity = 16 // Keep clear of the tiny allocator, which does not align
+	}
+	return make([]int8, n, capacity)
+}
+
+// NewMemoryModel creates the named memory model over a soup allocated with
+// NewSoup.
+func NewMemoryModel(name string, soup []int8) (MemoryModel, error) {
+	switch name {
+	case MemoryRacy:
+		return racyModel{}, nil
+	case MemoryStriped:
+		return newStripedMemory(soup), nil
+	case MemoryAtomic, MemoryTransactional:
+		words, err := newWordSoup(soup)
+		if err != nil {
+			return nil, err
+		}
+		if name == MemoryAtomic {
+			return &atomicMemory{words: words}, nil
+		}
+		return &txModel{words: words, versions: make([]uint32, txStripes)}, nil
+	}
+	return nil, fmt.Errorf("unknown memory model %q (available: %v)", name, MemoryModels)
+}
+
+// racyModel leaves IPs accessing the soup directly.
+type racyModel struct{}
+
+func (racyModel) Name() string  { return MemoryRacy }
+func (racyModel) ForIP() Memory { return nil }
+
+// wordSoup gives atomic access to single cells by operating on the aligned
+// 32-bit word that contains them.
+type wordSoup struct {
+	soup  []int8
+	shift [4]uint // Bit offset of each byte within its word
+}
+
+func newWordSoup(soup []int8) (*wordSoup, error) {
+	if len(soup) == 0 || cap(soup)%4 != 0 || uintptr(unsafe.Pointer(&soup[0]))%4 != 0 {
+		return nil, fmt.Errorf("soup is not word aligned, allocate it with vm.NewSoup")
+	}
+	w := &wordSoup{soup: soup[:cap(soup)]}
+	probe := uint32(0x03020100)
+	bytes := (*[4]byte)(unsafe.Pointer(&probe))
+	for i, b := range bytes {
+		w.shift[b] = uint(8 * i)
+	}
+	return w, nil
+}
+
+func (w *wordSoup) word(addr int32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&w.soup[addr&^3]))
+}
+
+func (w *wordSoup) load(addr int32) int8 {
+	return int8(atomic.LoadUint32(w.word(addr)) >> w.shift[addr&3])
+}
+
+func (w *wordSoup) store(addr int32, val int8) {
+	p := w.word(addr)
+	shift := w.shift[addr&3]
+	for {
+		old := atomic.LoadUint32(p)
+		updated := old&^(0xFF<<shift) | uint32(uint8(val))<<shift
+		if atomic.CompareAndSwapUint32(p, old, updated) {
+			return
+		}
+	}
+}
+
+// atomicMemory makes every load and store of a cell atomic.
+type atomicMemory struct {
+	words *wordSoup
+}
+
+func (m *atomicMemory) Name() string               { return MemoryAtomic }
+func (m *atomicMemory) ForIP() Memory              { return m }
+func (m *atomicMemory) Begin()                     {}
+func (m *atomicMemory) Load(addr int32) int8       { return m.words.load(addr) }
+func (m *atomicMemory) Store(addr int32, val int8) { m.words.store(addr, val) }
+func (m *atomicMemory) Commit() bool               { return true }
+
+// Cells are grouped into stripes of contiguous cells that share a lock (in
+// the striped model) or a version (in the transactional model).
+const (
+	stripeShift = 6 // 64 cells per stripe
+	stripeLocks = 4096
+	txStripes   = 1 << 16
+)
+
+// stripedMemory guards every cell access with the lock of its stripe.
+type stripedMemory struct {
+	soup  []int8
+	locks []sync.Mutex
+}
+
+func newStripedMemory(soup []int8) *stripedMemory {
+	return &stripedMemory{soup: soup, locks: make([]sync.Mutex, stripeLocks)}
+}
+
+func (m *stripedMemory) lock(addr int32) *sync.Mutex {
+	return &m.locks[(addr>>stripeShift)%stripeLocks]
+}
+
+func (m *stripedMemory) Name() string  { return MemoryStriped }
+func (m *stripedMemory) ForIP() Memory { return m }
+func (m *stripedMemory) Begin()        {}
+func (m *stripedMemory) Commit() bool  { return true }
+
+func (m *stripedMemory) Load(addr int32) int8 {
+	l := m.lock(addr)
+	l.Lock()
+	val := m.soup[addr]
+	l.Unlock()
+	return val
+}
+
+func (m *stripedMemory) Store(addr int32, val int8) {
+	l := m.lock(addr)
+	l.Lock()
+	m.soup[addr] = val
+	l.Unlock()
+}
+
+// txModel runs every step as an optimistic transaction. Each stripe has a
+// version that is odd while a commit holds it. A step records the versions of
+// the stripes it reads and buffers its write; the commit locks the written
+// stripe, checks that nothing it read has changed and then publishes the
+// write. Steps therefore appear to execute one at a time.
+type txModel struct {
+	words    *wordSoup
+	versions []uint32
+}
+
+func (m *txModel) Name() string { return MemoryTransactional }
+
+func (m *txModel) ForIP() Memory {
+	return &txMemory{model: m}
+}
+
+func (m *txModel) version(addr int32) *uint32 {
+	return &m.versions[(addr>>stripeShift)%txStripes]
+}
+
+type txRead struct {
+	version *uint32
+	seen    uint32
+}
+
+// txMemory is the transaction state of one IP.
+type txMemory struct {
+	model    *txModel
+	reads    []txRead
+	conflict bool
+	hasWrite bool
+	addr     int32
+	val      int8
+}
+
+func (t *txMemory) Begin() {
+	t.reads = t.reads[:0]
+	t.conflict = false
+	t.hasWrite = false
+}
+
+func (t *txMemory) Load(addr int32) int8 {
+	if t.hasWrite && addr == t.addr {
+		return t.val
+	}
+	v := t.model.version(addr)
+	seen := atomic.LoadUint32(v)
+	if seen&1 == 1 {
+		t.conflict = true // A commit is in progress, the value may be stale
+	}
+	val := t.model.words.load(addr)
+	t.reads = append(t.reads, txRead{version: v, seen: seen})
+	return val
+}
+
+func (t *txMemory) Store(addr int32, val int8) {
+	t.hasWrite = true
+	t.addr = addr
+	t.val = val
+}
+
+func (t *txMemory) Commit() bool {
+	if t.conflict {
+		runtime.Gosched()
+		return false
+	}
+	if !t.hasWrite {
+		return t.validate(nil, 0)
+	}
+	w := t.model.version(t.addr)
+	locked := atomic.LoadUint32(w)
+	if locked&1 == 1 || !atomic.CompareAndSwapUint32(w, locked, locked+1) {
+		runtime.Gosched()
+		return false
+	}
+	if !t.validate(w, locked) {
+		atomic.StoreUint32(w, locked) // Release without publishing
+		runtime.Gosched()
+		return false
+	}
+	t.model.words.store(t.addr, t.val)
+	atomic.StoreUint32(w, locked+2)
+	return true
+}
+
+// validate checks that no stripe read by the step has changed. The stripe
+// locked for the write is compared against its version before locking.
+func (t *txMemory) validate(locked *uint32, before uint32) bool {
+	for _, r := range t.reads {
+		current := atomic.LoadUint32(r.version)
+		if r.version == locked {
+			current = before
+		}
+		if current != r.seen {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package vm
+
+import (
+	"sync"
+	"testing"
+)
+
+// step runs fn as one step through mem, retrying it until it commits, as
+// IP.Step does.
+func step(mem Memory, fn func(mem Memory)) {
+	for {
+		mem.Begin()
+		fn(mem)
+		if mem.Commit() {
+			return
+		}
+	}
+}
+
+func TestMemoryModelsKeepEveryWrite(t *testing.T) {
+	const (
+		writers = 8
+		cells   = 64 // Each word holds cells of four writers
+		rounds  = 2000
+	)
+	for _, name := range []string{MemoryAtomic, MemoryStriped, MemoryTransactional} {
+		t.Run(name, func(t *testing.T) {
+			soup := NewSoup(writers * cells)
+			model, err := NewMemoryModel(name, soup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Writer w owns the cells at w, w+writers, w+2*writers, ... and
+			// writes them with values only it uses, then checks them.
+			var wg sync.WaitGroup
+			errs := make(chan string, writers)
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					mem := model.ForIP()
+					for r := 0; r < rounds; r++ {
+						val := int8(w<<4 | r&0xF)
+						for c := 0; c < cells; c++ {
+							addr := int32(c*writers + w)
+							step(mem, func(mem Memory) { mem.Store(addr, val) })
+						}
+						for c := 0; c < cells; c++ {
+							addr := int32(c*writers + w)
+							var got int8
+							step(mem, func(mem Memory) { got = mem.Load(addr) })
+							if got != val {
+								errs <- name + ": a write was lost or torn"
+								return
+							}
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+			for addr, got := range soup {
+				w := addr % writers
+				if want := int8(w<<4 | (rounds-1)&0xF); got != want {
+					t.Errorf("cell %d holds %d, want %d", addr, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTransactionalMemoryIsSerializable(t *testing.T) {
+	const (
+		writers    = 8
+		increments = 1000
+	)
+	soup := NewSoup(16)
+	model, err := NewMemoryModel(MemoryTransactional, soup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every writer increments the same cell; a step that read a stale value
+	// would lose another writer's increment.
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mem := model.ForIP()
+			for i := 0; i < increments; i++ {
+				step(mem, func(mem Memory) { mem.Store(5, mem.Load(5)+1) })
+			}
+		}()
+	}
+	wg.Wait()
+	total := writers * increments
+	if want := int8(total); soup[5] != want {
+		t.Errorf("counter is %d after %d increments, want %d", soup[5], total, want)
+	}
+}
@@ -0,0 +1,44 @@
+package vm
+
+// StepEvent describes everything an IP did during one call to Step.
+type StepEvent struct {
+	ID          int
+	Step        int64 // Index of this step in the IP's life (Steps before the call)
+	X, Y        int32 // Fetch location
+	Instruction int8  // Raw instruction byte
+	Decoded     Decoded
+	Src1Addr    int32
+	Src1Val     int8
+	Src2Addr    int32
+	Src2Val     int8
+	DestAddr    int32
+	OldValue    int8 // Value at DestAddr before the write
+	Result      int8 // Value written to DestAddr
+	JumpTaken   bool
+	NextX       int32 // Location after the jump and move
+	NextY       int32
+}
+
+// Observer receives a StepEvent after every step of the IP it is attached to.
+// It runs on the goroutine executing the IP, so it must be cheap and must
+// synchronize any state shared with other IPs. Returning true asks the
+// scheduler to halt the IP before anything else executes, see IP.Step.
+type Observer interface {
+	ObserveStep(ev StepEvent) bool
+}
+
+// Observers fans a step out to several observers, so independent tools can
+// watch the same IP.
+type Observers []Observer
+
+// ObserveStep calls each observer in order and asks for a halt if any of
+// them does.
+func (o Observers) ObserveStep(ev StepEvent) bool {
+	halt := false
+	for _, obs := range o {
+		if obs.ObserveStep(ev) {
+			halt = true
+		}
+	}
+	return halt
+}
@@ -0,0 +1,79 @@
+package vm
+
+import "testing"
+
+// recorder keeps every step it observes and asks for a halt if halt is set.
+type recorder struct {
+	events []StepEvent
+	halt   bool
+}
+
+func (r *recorder) ObserveStep(ev StepEvent) bool {
+	r.events = append(r.events, ev)
+	return r.halt
+}
+
+func TestObserverSeesStep(t *testing.T) {
+	soup := make([]int8, 8*8)
+	soup[2*8+2] = 0x10 // ADD N, E -> S1
+	soup[1*8+2] = 5    // North
+	soup[2*8+3] = 7    // East
+	ip := NewIP(3, soup, 2, 2, 8, false, true)
+	ip.Rand = NewRNG(1, 3)
+	ip.Steps = 41
+
+	preview := ip.Preview()
+	rec := &recorder{}
+	ip.Observer = rec
+	if halt := ip.Step(); halt {
+		t.Error("Step halted without being asked to")
+	}
+	if len(rec.events) != 1 {
+		t.Fatalf("observed %d steps, want 1", len(rec.events))
+	}
+	want := StepEvent{
+		ID:          3,
+		Step:        41,
+		X:           2,
+		Y:           2,
+		Instruction: 0x10,
+		Decoded:     Decoded{Op: OP_ADD},
+		Src1Addr:    10,
+		Src1Val:     5,
+		Src2Addr:    19,
+		Src2Val:     7,
+		DestAddr:    10,
+		OldValue:    5,
+		Result:      12,
+		NextX:       ip.X,
+		NextY:       ip.Y,
+	}
+	if got := rec.events[0]; got != want {
+		t.Errorf("observed %+v, want %+v", got, want)
+	}
+	if soup[10] != 12 || ip.Steps != 42 {
+		t.Errorf("step left cell 10 at %d and %d steps", soup[10], ip.Steps)
+	}
+	// The preview matches the step, except for the move it cannot know.
+	want.NextX, want.NextY = 2, 2
+	if preview != want {
+		t.Errorf("previewed %+v, want %+v", preview, want)
+	}
+}
+
+func TestObserversHalt(t *testing.T) {
+	soup := make([]int8, 8*8)
+	ip := NewIP(1, soup, 0, 0, 8, false, true)
+	first, second := &recorder{}, &recorder{halt: true}
+	ip.Observer = Observers{first, second}
+	if halt := ip.Step(); !halt {
+		t.Error("Step did not halt when an observer asked it to")
+	}
+	if len(first.events) != 1 || len(second.events) != 1 {
+		t.Errorf("observers saw %d and %d steps, want 1 each", len(first.events), len(second.events))
+	}
+	second.halt = false
+	if halt := ip.Step(); halt {
+		t.Error("Step halted when no observer asked it to")
+	}
+}
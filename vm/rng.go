@@ -0,0 +1,39 @@
+package vm
+
+// RNG is a small splitmix64 generator. Unlike math/rand sources, its whole
+// state is a single exported word, so it can be saved in a snapshot and
+// restored to continue the exact same stream.
+type RNG struct {
+	State uint64
+}
+
+// NewRNG derives an independent stream from a run seed and a stream number
+// (for example an IP's ID), so that every IP draws its own reproducible
+// sequence regardless of how other IPs are scheduled.
+func NewRNG(seed int64, stream uint64) *RNG {
+	r := &RNG{State: uint64(seed) ^ (stream * 0xD1B54A32D192ED03)}
+	r.Uint64() // Mix the seed so neighbouring streams diverge immediately
+	return r
+}
+
+// Uint64 returns the next 64 pseudo-random bits of the stream.
+func (r *RNG) Uint64() uint64 {
+	r.State += 0x9E3779B97F4A7C15
+	z := r.State
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return z ^ (z >> 31)
+}
+
+// Intn returns a pseudo-random number in [0, n). It panics if n <= 0.
+func (r *RNG) Intn(n int) int {
+	if n <= 0 {
+		panic("vm: invalid argument to RNG.Intn")
+	}
+	return int(r.Uint64() % uint64(n))
+}
+
+// Float64 returns a pseudo-random number in [0.0, 1.0).
+func (r *RNG) Float64() float64 {
+	return float64(r.Uint64()>>11) / (1 << 53)
+}
@@ -3,9 +3,10 @@ package vm
 import "math/rand"
 
 // --- Micro-Architectural Instruction Format ---
-// An instruction is a single byte, decoded as a bitfield:
+// An instruction is a single byte. The classic ISA decodes it as a bitfield:
 // [ALU_Op(4) | S1_Ptr(1) | S2_Ptr(1) | Destination(2)]
 // MSB.............................................LSB
+// Other instruction sets can be registered with RegisterISA (see isa.go).
 
 const NumAluBits = 4 // For websocket.go
 
@@ -35,7 +36,7 @@ type OpcodeInfo struct {
 	Value uint8  `json:"value"`
 }
 
-// GetOpcodes returns a list of all defined opcodes and their values.
+// GetOpcodes returns a list of all opcodes of the classic ISA and their values.
 func GetOpcodes() []OpcodeInfo {
 	return []OpcodeInfo{
 		{Name: "CPY", Value: OP_CPY},
@@ -57,6 +58,9 @@ func GetOpcodes() []OpcodeInfo {
 	}
 }
 
+// OpCounts counts executed instructions by instruction byte.
+type OpCounts [256]int64
+
 // IP represents an Instruction Pointer, our digital organism.
 type IP struct {
 	ID                    int
@@ -67,6 +71,34 @@ type IP struct {
 	UseRelativeAddressing bool
 	SoupDimX              int32
 	SoupDimY              int32
+	Weight                int32 // Relative share of execution under weighted scheduling
+
+	// SpawnOp, unless it is NoSpawn, is the ALU op that also releases a new
+	// IP at the jump address. Step only records the request in Spawn,
+	// SpawnX and SpawnY; the scheduler creates the new IP and clears Spawn.
+	SpawnOp        int16
+	Spawn          bool
+	SpawnX, SpawnY int32
+
+	// ISA decodes and executes the instruction bytes. NewIP uses the
+	// default instruction set.
+	ISA ISA
+
+	// Observer, when set, is told about every step. A nil Observer costs a
+	// single comparison per step.
+	Observer Observer
+
+	// Memory, when set, mediates every soup access of Step. A nil Memory
+	// reads and writes Soup directly.
+	Memory Memory
+
+	// Counts, when set, counts every instruction Step executes. It is not
+	// synchronized, so only IPs stepped by the same goroutine may share it.
+	Counts *OpCounts
+
+	// Rand, when set, supplies the movement direction instead of the global
+	// math/rand source. Deterministic runs give each IP its own stream.
+	Rand *RNG
 }
 
 // SavableIP defines the data for an IP that can be saved in a snapshot.
@@ -74,7 +106,9 @@ type SavableIP struct {
 	ID                 int
 	X, Y               int32
 	Steps              int64
-	CurrentInstruction int8 // The raw instruction byte at CurrentPtr
+	CurrentInstruction int8   // The raw instruction byte at CurrentPtr
+	RandState          uint64 // State of the IP's own RNG stream, 0 if it has none
+	Weight             int32
 }
 
 func (ip *IP) wrap(val, max int32) int32 {
@@ -88,15 +122,23 @@ func (ip *IP) to1D(x, y int32) int32 {
 // CurrentState returns a serializable representation of the IP.
 func (ip *IP) CurrentState() SavableIP {
 	addr := ip.to1D(ip.X, ip.Y)
-	return SavableIP{
+	state := SavableIP{
 		ID:                 ip.ID,
 		X:                  ip.X,
 		Y:                  ip.Y,
 		Steps:              ip.Steps,
 		CurrentInstruction: ip.Soup[addr],
+		Weight:             ip.Weight,
+	}
+	if ip.Rand != nil {
+		state.RandState = ip.Rand.State
 	}
+	return state
 }
 
+// NoSpawn disables spawning through IP.SpawnOp.
+const NoSpawn int16 = -1
+
 // NewIP creates a new, minimal instruction pointer.
 func NewIP(id int, soup []int8, x, y, soupDimX int32, use32BitAddressing bool, useRelativeAddressing bool) *IP {
 	ip := &IP{
@@ -108,131 +150,82 @@ func NewIP(id int, soup []int8, x, y, soupDimX int32, use32BitAddressing bool, u
 		UseRelativeAddressing: useRelativeAddressing,
 		SoupDimX:              soupDimX,
 		SoupDimY:              int32(len(soup)) / soupDimX,
+		Weight:                1,
+		SpawnOp:               NoSpawn,
+		ISA:                   defaultISA(),
 	}
 	return ip
 }
 
-// Step executes a single instruction from the soup.
-func (ip *IP) Step() {
-	// --- Fetch and Decode ---
-	locX, locY := ip.X, ip.Y
-	instruction := uint8(ip.Soup[ip.to1D(locX, locY)])
+// resolveAddress turns an operand into a soup address (the "pointer
+// infrastructure"), according to the IP's addressing modes.
+func (ip *IP) resolveAddress(baseX, baseY int32, offset int32) int32 {
+	var finalX, finalY int32
+	if ip.UseRelativeAddressing {
+		if ip.Use32BitAddressing {
+			dx := int32(int16(offset & 0xFFFF))
+			dy := int32(int16(offset >> 16))
+			finalX = baseX + dx
+			finalY = baseY + dy
+		} else { // 8-bit relative
+			dx := int32(int8(byte(offset)<<4) >> 4) // sign extend low nibble
+			dy := int32(int8(byte(offset)) >> 4)    // sign extend high nibble
+			finalX = baseX + dx
+			finalY = baseY + dy
+		}
+	} else { // Absolute addressing
+		if ip.Use32BitAddressing {
+			finalX = offset & 0xFFFF
+			finalY = (offset >> 16) & 0xFFFF
+		} else {
+			finalX = offset & 0xFF
+			finalY = (offset >> 8) & 0xFF // Use top 8 bits for Y in absolute 16-bit
+		}
+	}
+	return ip.to1D(finalX, finalY)
+}
 
-	aluOp := (instruction >> 4) & 0x0F
-	s1PtrMode := (instruction >> 3) & 0x01
-	s2PtrMode := (instruction >> 2) & 0x01
-	destSel := instruction & 0x03
-	direction := rand.Intn(4)
+// decodeAt fetches and decodes the instruction at (locX, locY), reads its
+// operands and computes its result and destination, without changing the
+// soup or the IP.
+func (ip *IP) decodeAt(locX, locY int32) StepEvent {
+	// --- Fetch and Decode ---
+	instruction := uint8(ip.load(ip.to1D(locX, locY)))
+	decoded := ip.ISA.Decode(instruction)
 
 	// --- Define Neighbor Locations ---
 	northX, northY := locX, locY-1
 	eastX, eastY := locX+1, locY
 
-	// --- Helper for address resolution (the "pointer infrastructure") ---
-	resolveAddress := func(baseX, baseY int32, offset int32) int32 {
-		var finalX, finalY int32
-		if ip.UseRelativeAddressing {
-			if ip.Use32BitAddressing {
-				dx := int32(int16(offset & 0xFFFF))
-				dy := int32(int16(offset >> 16))
-				finalX = baseX + dx
-				finalY = baseY + dy
-			} else { // 8-bit relative
-				dx := int32(int8(byte(offset)<<4) >> 4) // sign extend low nibble
-				dy := int32(int8(byte(offset)) >> 4)      // sign extend high nibble
-				finalX = baseX + dx
-				finalY = baseY + dy
-			}
-		} else { // Absolute addressing
-			if ip.Use32BitAddressing {
-				finalX = offset & 0xFFFF
-				finalY = (offset >> 16) & 0xFFFF
-			} else {
-				finalX = offset & 0xFF
-				finalY = (offset >> 8) & 0xFF // Use top 8 bits for Y in absolute 16-bit
-			}
-		}
-		return ip.to1D(finalX, finalY)
-	}
-
 	// --- Fetch Operands ---
 	var src1Val, src2Val int8
 	var src1Addr, src2Addr int32
 	// Fetch Src1 from North
-	if s1PtrMode == 0 { // Value Mode
+	if !decoded.S1Ptr { // Value Mode
 		src1Addr = ip.to1D(northX, northY)
-		src1Val = ip.Soup[src1Addr]
+		src1Val = ip.load(src1Addr)
 	} else { // Pointer Mode
-		offset := int32(ip.Soup[ip.to1D(northX, northY)])
-		src1Addr = resolveAddress(northX, northY, offset)
-		src1Val = ip.Soup[src1Addr]
+		offset := int32(ip.load(ip.to1D(northX, northY)))
+		src1Addr = ip.resolveAddress(northX, northY, offset)
+		src1Val = ip.load(src1Addr)
 	}
 
 	// Fetch Src2 from East
-	if s2PtrMode == 0 { // Value Mode
+	if !decoded.S2Ptr { // Value Mode
 		src2Addr = ip.to1D(eastX, eastY)
-		src2Val = ip.Soup[src2Addr]
+		src2Val = ip.load(src2Addr)
 	} else { // Pointer Mode
-		offset := int32(ip.Soup[ip.to1D(eastX, eastY)])
-		src2Addr = resolveAddress(eastX, eastY, offset)
-		src2Val = ip.Soup[src2Addr]
+		offset := int32(ip.load(ip.to1D(eastX, eastY)))
+		src2Addr = ip.resolveAddress(eastX, eastY, offset)
+		src2Val = ip.load(src2Addr)
 	}
 
-	// --- 1. Calculate & Jump Condition Phase ---
-	var result int8
-	jumpTaken := false
-
-	switch aluOp {
-	case OP_CPY:
-		result = int8(instruction) // Copy self
-	case OP_ADD:
-		result = src1Val + src2Val
-	case OP_SUB:
-		result = src1Val - src2Val
-	case OP_NAND:
-		result = ^(src1Val & src2Val)
-	case OP_OR:
-		result = src1Val | src2Val
-	case OP_AND:
-		result = src1Val & src2Val
-	case OP_XOR:
-		result = src1Val ^ src2Val
-	case OP_NOT_S1:
-		result = ^src1Val
-	case OP_MOV_S1:
-		result = src1Val
-	case OP_MOV_S2:
-		result = src2Val
-	case OP_INC_S1:
-		result = src1Val + 1
-	case OP_DEC_S1:
-		result = src1Val - 1
-	case OP_JMP:
-		jumpTaken = true
-		result = int8(instruction) // Copy self
-	case OP_JZ:
-		if src1Val == 0 {
-			jumpTaken = true
-		}
-		result = int8(instruction) // Copy self
-	case OP_JNZ:
-		if src1Val != 0 {
-			jumpTaken = true
-		}
-		result = int8(instruction) // Copy self
-	case OP_JNEG:
-		if src1Val < 0 {
-			jumpTaken = true
-		}
-		result = int8(instruction) // Copy self
-	default:
-		// Undefined opcodes are CPYs
-		result = int8(instruction) // Copy self
-	}
+	// --- Calculate & Jump Condition ---
+	result, jumpTaken := ip.ISA.Execute(decoded.Op, int8(instruction), src1Val, src2Val)
 
-	// --- 2. Write Phase ---
+	// --- Destination ---
 	var destAddr int32
-	switch destSel {
+	switch decoded.Dest {
 	case 0:
 		destAddr = src1Addr
 	case 1:
@@ -242,17 +235,92 @@ func (ip *IP) Step() {
 	case 3:
 		// Write to the address pointed to by src2 (the jump address)
 		jumpOffset := int32(src2Val)
-		destAddr = resolveAddress(locX, locY, jumpOffset)
+		destAddr = ip.resolveAddress(locX, locY, jumpOffset)
+	}
+
+	return StepEvent{
+		ID:          ip.ID,
+		Step:        ip.Steps,
+		X:           locX,
+		Y:           locY,
+		Instruction: int8(instruction),
+		Decoded:     decoded,
+		Src1Addr:    src1Addr,
+		Src1Val:     src1Val,
+		Src2Addr:    src2Addr,
+		Src2Val:     src2Val,
+		DestAddr:    destAddr,
+		Result:      result,
+		JumpTaken:   jumpTaken,
+	}
+}
+
+// Preview decodes the instruction the IP will execute next and resolves its
+// operands, without executing it. NextX and NextY hold the jump target if the
+// jump would be taken and the current location otherwise, since the move
+// direction is only drawn when the IP steps.
+func (ip *IP) Preview() StepEvent {
+	ev := ip.decodeAt(ip.X, ip.Y)
+	ev.OldValue = ip.load(ev.DestAddr)
+	ev.NextX, ev.NextY = ip.X, ip.Y
+	if ev.JumpTaken {
+		jumpIndex := ip.resolveAddress(ip.X, ip.Y, int32(ev.Src2Val))
+		ev.NextX = jumpIndex % ip.SoupDimX
+		ev.NextY = jumpIndex / ip.SoupDimX
+	}
+	return ev
+}
+
+// Step executes a single instruction from the soup. It reports whether the
+// Observer asked to halt, which schedulers check before stepping any other
+// IP.
+func (ip *IP) Step() (halt bool) {
+	locX, locY := ip.X, ip.Y
+	var direction int
+	if ip.Rand != nil {
+		direction = ip.Rand.Intn(4)
+	} else {
+		direction = rand.Intn(4)
+	}
+
+	var ev StepEvent
+	for {
+		if ip.Memory != nil {
+			ip.Memory.Begin()
+		}
+
+		// --- 1. Fetch, Decode, Calculate & Jump Condition Phase ---
+		ev = ip.decodeAt(locX, locY)
+
+		// --- 2. Write Phase ---
+		if ip.Observer != nil {
+			ev.OldValue = ip.load(ev.DestAddr)
+		}
+		ip.store(ev.DestAddr, ev.Result)
+
+		// A transactional memory may ask for the step to be executed again.
+		if ip.Memory == nil || ip.Memory.Commit() {
+			break
+		}
+	}
+	if ip.Counts != nil {
+		ip.Counts[uint8(ev.Instruction)]++
+	}
+
+	if ip.SpawnOp != NoSpawn && int16(ev.Decoded.Op) == ip.SpawnOp {
+		spawnIndex := ip.resolveAddress(locX, locY, int32(ev.Src2Val))
+		ip.Spawn = true
+		ip.SpawnX = spawnIndex % ip.SoupDimX
+		ip.SpawnY = spawnIndex / ip.SoupDimX
 	}
-	ip.Soup[destAddr] = result
 
 	// --- 3. Jump / Move Phase ---
-	if jumpTaken {
-		jumpOffset := int32(src2Val) // Src2 provides the offset
-		jumpIndex := resolveAddress(locX, locY, jumpOffset)
+	if ev.JumpTaken {
+		jumpOffset := int32(ev.Src2Val) // Src2 provides the offset
+		jumpIndex := ip.resolveAddress(locX, locY, jumpOffset)
 		ip.X = jumpIndex % ip.SoupDimX
 		ip.Y = jumpIndex / ip.SoupDimX
-	} 
+	}
 	// Move IP
 	switch direction {
 	case 0:
@@ -268,5 +336,11 @@ func (ip *IP) Step() {
 	// --- Final Wrap ---
 	ip.X = ip.wrap(ip.X, ip.SoupDimX)
 	ip.Y = ip.wrap(ip.Y, ip.SoupDimY)
+
+	if ip.Observer != nil {
+		ev.NextX, ev.NextY = ip.X, ip.Y
+		halt = ip.Observer.ObserveStep(ev)
+	}
 	ip.Steps++
+	return halt
 }
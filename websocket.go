@@ -3,10 +3,13 @@ package main
 import (
 	"encoding/json"
 	"evolution/vm"
+	"fmt"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -23,9 +26,10 @@ const (
 
 // InstructionInfoMessage contains all opcode information for the client.
 type InstructionInfoMessage struct {
-	Type      string        `json:"type"`
+	Type      string          `json:"type"`
+	ISA       string          `json:"isa"`
 	Opcodes   []vm.OpcodeInfo `json:"opcodes"`
-	AluOpBits int           `json:"alu_op_bits"`
+	AluOpBits int             `json:"alu_op_bits"`
 }
 
 // SimParamsMessage contains simulation parameters.
@@ -34,6 +38,61 @@ type SimParamsMessage struct {
 	CosmicRayRate float64 `json:"cosmicRayRate"`
 	SoupSize      int     `json:"soupSize"`
 	SoupGridDim   int     `json:"soupGridDim"`
+	VisDim        int     `json:"visDim"`
+	Use32Bit      bool    `json:"use32BitAddressing"`
+	Relative      bool    `json:"useRelativeAddressing"`
+}
+
+// SnapshotSavedMessage reports a snapshot written during the run.
+type SnapshotSavedMessage struct {
+	Type   string `json:"type"`
+	File   string `json:"file"`
+	Reason string `json:"reason"`
+}
+
+// TimeTravelRequest asks the main loop to list the timeline or to restore a
+// point of it, see timeline.go.
+type TimeTravelRequest struct {
+	Command string  // "list", "rewind" or "seek"
+	Seconds float64 // Run time to go back by, or to seek to
+}
+
+// TimelineMessage describes the timeline, and the result of a rewind or seek.
+type TimelineMessage struct {
+	Type     string              `json:"type"`
+	Points   []TimelinePointInfo `json:"points"`
+	Elapsed  float64             `json:"elapsed"`            // Current run time in seconds
+	Restored *float64            `json:"restored,omitempty"` // Run time of the restored point
+	Error    string              `json:"error,omitempty"`
+}
+
+// InstructionMixMessage reports the instruction mix of the soup (static) and
+// of every instruction the IPs executed since the previous message (dynamic),
+// see mix.go.
+type InstructionMixMessage struct {
+	Type       string          `json:"type"`
+	Generation string          `json:"generation"`
+	Opcodes    []vm.OpcodeInfo `json:"opcodes"`
+	Static     *InstructionMix `json:"static"`
+	Dynamic    *InstructionMix `json:"dynamic"`
+}
+
+// MotifsMessage reports the motifs found in the soup, see motifs.go.
+type MotifsMessage struct {
+	Type    string  `json:"type"`
+	Elapsed float64 `json:"elapsed"` // Run time of the search in seconds
+	Length  int     `json:"length"`  // Cells per motif
+	Motifs  []Motif `json:"motifs"`
+}
+
+// DisassemblyMessage answers a disassemble request for a region of the soup.
+type DisassemblyMessage struct {
+	Type  string     `json:"type"`
+	X     int32      `json:"x"`
+	Y     int32      `json:"y"`
+	Rows  [][]string `json:"rows"`
+	Text  string     `json:"text"`
+	Error string     `json:"error,omitempty"`
 }
 
 var upgrader = websocket.Upgrader{
@@ -46,7 +105,7 @@ var upgrader = websocket.Upgrader{
 
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
-	hub *Hub
+	hub      *Hub
 	appState *AppState
 
 	// The websocket connection.
@@ -66,7 +125,7 @@ func (c *Client) readPump() {
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
 
-		// Handle incoming messages from the client.
+	// Handle incoming messages from the client.
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
@@ -102,6 +161,13 @@ func (c *Client) readPump() {
 				c.hub.Pause <- false
 			case "step":
 				c.appState.Step()
+				broadcastDebugState(c.hub, c.appState, "")
+			case "snapshot":
+				select {
+				case c.hub.SaveSnapshot <- struct{}{}:
+				default:
+					log.Println("Snapshot already requested, dropping message.")
+				}
 			default:
 				log.Printf("Unknown command received: %s", msg.Command)
 			}
@@ -114,6 +180,38 @@ func (c *Client) readPump() {
 		case "set_ip_ptr":
 			log.Printf("Received set_ip_ptr for IP %d to %d", msg.ID, msg.Ptr)
 			c.appState.SetIPPtr(msg.ID, msg.Ptr)
+		case "debug":
+			log.Printf("Received debug command: %s", msg.Command)
+			switch msg.Command {
+			case "focus":
+				c.appState.SetDebugFocus(msg.ID)
+			case "step_ip":
+				c.appState.StepIP(msg.ID)
+			case "break":
+				c.appState.SetBreakpoint(msg.Ptr, true)
+			case "unbreak":
+				c.appState.SetBreakpoint(msg.Ptr, false)
+			case "watch":
+				c.appState.SetWatchpoint(msg.Ptr, true)
+			case "unwatch":
+				c.appState.SetWatchpoint(msg.Ptr, false)
+			case "clear":
+				c.appState.ClearDebugPoints()
+			default:
+				log.Printf("Unknown debug command received: %s", msg.Command)
+			}
+			broadcastDebugState(c.hub, c.appState, "")
+		case "timeline":
+			log.Printf("Received timeline command: %s %g", msg.Command, msg.Value)
+			select {
+			case c.hub.TimeTravel <- TimeTravelRequest{Command: msg.Command, Seconds: msg.Value}:
+			default:
+				log.Println("Timeline channel is full, dropping message.")
+			}
+		case "disassemble":
+			if err := c.sendDisassembly(msg.X, msg.Y, msg.W, msg.H); err != nil {
+				log.Printf("Error sending disassembly: %v", err)
+			}
 		default:
 			log.Printf("Unknown message type received: %s", msg.Type)
 		}
@@ -157,12 +255,14 @@ func (c *Client) writePump() {
 
 // Hub maintains the set of active clients and broadcasts messages to them.
 type Hub struct {
-	clients     map[*Client]bool
-	Broadcast   chan []byte
-	Register    chan *Client
-	Unregister  chan *Client
+	clients          map[*Client]bool
+	Broadcast        chan []byte
+	Register         chan *Client
+	Unregister       chan *Client
 	SetCosmicRayRate chan float64
-	Pause       chan bool
+	Pause            chan bool
+	SaveSnapshot     chan struct{}
+	TimeTravel       chan TimeTravelRequest
 }
 
 // UIMessage defines the structure for incoming JSON messages from the UI.
@@ -172,18 +272,23 @@ type UIMessage struct {
 	Command string  `json:"command"`
 	ID      int     `json:"id"`  // For IP tracking commands
 	Ptr     int32   `json:"ptr"` // For setting IP pointer
+	X       int32   `json:"x"`   // Region for disassembly
+	Y       int32   `json:"y"`
+	W       int32   `json:"w"`
+	H       int32   `json:"h"`
 }
 
-
 // NewHub creates a new Hub object.
 func NewHub() *Hub {
 	return &Hub{
-		Broadcast:   make(chan []byte, 256),
-		Register:    make(chan *Client),
-		Unregister:  make(chan *Client),
-		clients:     make(map[*Client]bool),
+		Broadcast:        make(chan []byte, 256),
+		Register:         make(chan *Client),
+		Unregister:       make(chan *Client),
+		clients:          make(map[*Client]bool),
 		SetCosmicRayRate: make(chan float64, 8),
-		Pause:       make(chan bool, 8),
+		Pause:            make(chan bool, 8),
+		SaveSnapshot:     make(chan struct{}, 1),
+		TimeTravel:       make(chan TimeTravelRequest, 8),
 	}
 }
 
@@ -228,7 +333,6 @@ func handleWebSocket(hub *Hub, appState *AppState, w http.ResponseWriter, r *htt
 		log.Printf("Error sending instruction set: %v", err)
 	}
 
-
 	// Send initial simulation parameters.
 	if err := client.sendSimParams(); err != nil {
 		log.Printf("Error sending sim params: %v", err)
@@ -240,18 +344,25 @@ func handleWebSocket(hub *Hub, appState *AppState, w http.ResponseWriter, r *htt
 	go client.readPump()
 }
 
-func (c *Client) sendSimParams() error {
-	currentRateBits := atomic.LoadUint64(&c.appState.cosmicRayRate)
+// simParams encodes the current simulation parameters.
+func simParams(appState *AppState) ([]byte, error) {
+	currentRateBits := atomic.LoadUint64(&appState.cosmicRayRate)
 	p := math.Float64frombits(currentRateBits)
 
 	msg := SimParamsMessage{
 		Type:          "sim_params",
 		CosmicRayRate: p,
-		SoupSize:      SoupSize,
-		SoupGridDim:   SoupGridDim,
+		SoupSize:      len(appState.soup),
+		SoupGridDim:   appState.config.SoupGridDim,
+		VisDim:        appState.config.VisDim,
+		Use32Bit:      appState.Use32BitAddressing,
+		Relative:      appState.UseRelativeAddressing,
 	}
+	return json.Marshal(msg)
+}
 
-	encodedMsg, err := json.Marshal(msg)
+func (c *Client) sendSimParams() error {
+	encodedMsg, err := simParams(c.appState)
 	if err != nil {
 		return err
 	}
@@ -265,10 +376,12 @@ func (c *Client) sendSimParams() error {
 }
 
 func (c *Client) sendInstructionSet() error {
+	isa := c.appState.isa
 	msg := InstructionInfoMessage{
 		Type:      "instruction_info",
-		Opcodes:   vm.GetOpcodes(),
-		AluOpBits: vm.NumAluBits,
+		ISA:       isa.Name(),
+		Opcodes:   isa.Opcodes(),
+		AluOpBits: isa.OpBits(),
 	}
 
 	encodedMsg, err := json.Marshal(msg)
@@ -284,6 +397,74 @@ func (c *Client) sendInstructionSet() error {
 	return nil
 }
 
+func (c *Client) sendDisassembly(x, y, w, h int32) error {
+	msg := DisassemblyMessage{Type: "disassembly", X: x, Y: y}
+	rows, err := c.appState.Disassemble(x, y, w, h)
+	if err != nil {
+		msg.Error = err.Error()
+	} else {
+		msg.Rows = rows
+		msg.Text = vm.FormatDisassembly(rows)
+	}
+
+	encodedMsg, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case c.send <- encodedMsg:
+	default:
+		log.Println("Client send channel is full, dropping disassembly message.")
+	}
+	return nil
+}
+
+// serveDisassembly writes the disassembly of the region given by the x, y, w
+// and h query parameters as plain text.
+func serveDisassembly(appState *AppState, w http.ResponseWriter, r *http.Request) {
+	var region [4]int32
+	for i, name := range []string{"x", "y", "w", "h"} {
+		v, err := strconv.ParseInt(r.URL.Query().Get(name), 10, 32)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid parameter %q: %v", name, err), http.StatusBadRequest)
+			return
+		}
+		region[i] = int32(v)
+	}
+	rows, err := appState.Disassemble(region[0], region[1], region[2], region[3])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, vm.FormatDisassembly(rows))
+}
+
+// serveLineage answers /lineage?format=json|dot|graphml with the lineage of
+// the motifs found so far, JSON by default.
+func serveLineage(motifs *MotifAnalyzer, w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = LineageJSON
+	}
+	contentTypes := map[string]string{
+		LineageJSON:    "application/json",
+		LineageDOT:     "text/vnd.graphviz; charset=utf-8",
+		LineageGraphML: "application/graphml+xml",
+	}
+	contentType, ok := contentTypes[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown lineage format %q", format), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=lineage.%s", format))
+	if err := writeLineage(w, format, motifs.Lineage()); err != nil {
+		log.Printf("Error serving lineage: %v", err)
+	}
+}
+
 // serveIndex serves the main HTML file.
 func serveIndex(w http.ResponseWriter, r *http.Request) {
 	if _, err := os.Stat("index.html"); os.IsNotExist(err) {
@@ -293,15 +474,33 @@ func serveIndex(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "index.html")
 }
 
-// StartServer initializes HTTP routes and starts the web server.
-func StartServer(hub *Hub, appState *AppState) {
+// serverURL returns the URL of the frontend served on a listen address.
+func serverURL(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// StartServer initializes HTTP routes and starts the web server on addr.
+func StartServer(hub *Hub, appState *AppState, motifs *MotifAnalyzer, addr string) {
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		handleWebSocket(hub, appState, w, r)
 	})
+	http.HandleFunc("/disassemble", func(w http.ResponseWriter, r *http.Request) {
+		serveDisassembly(appState, w, r)
+	})
+	http.HandleFunc("/lineage", func(w http.ResponseWriter, r *http.Request) {
+		serveLineage(motifs, w, r)
+	})
 	http.HandleFunc("/", serveIndex)
 
-	log.Println("Starting web server on http://localhost:8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	log.Printf("Starting web server on %s", serverURL(addr))
+	if err := http.ListenAndServe(addr, nil); err != nil {
 		log.Fatal("ListenAndServe Error: ", err)
 	}
 }